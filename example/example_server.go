@@ -3,35 +3,41 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
 	"github.com/1lann/go-sip/server"
 	"github.com/1lann/go-sip/sipnet"
 )
 
 func main() {
-	listener, err := sipnet.Listen("0.0.0.0:5080")
-	if err != nil {
-		panic(err)
+	mux := sipnet.NewServeMux()
+	mux.HandleFunc(sipnet.MethodRegister, server.HandleRegister)
+	mux.HandleFunc(sipnet.MethodInvite, server.HandleInvite)
+
+	srv := &sipnet.Server{
+		Addr:    "0.0.0.0:5080",
+		Handler: sipnet.Chain(mux, sipnet.Logging(nil), sipnet.Recovery),
 	}
 
-	defer listener.Close()
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
 
-	for {
-		req, conn, err := listener.AcceptRequest()
-		if err != nil {
-			fmt.Println("accept request error:", err)
-			continue
+		// Give calls in progress a few seconds to finish.
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Println("shutdown error:", err)
 		}
+	}()
 
-		fmt.Println("received request")
-
-		switch req.Method {
-		case sipnet.MethodRegister:
-			server.HandleRegister(req, conn)
-		case sipnet.MethodInvite:
-			server.HandleInvite(req, conn)
-		default:
-			fmt.Println("unknown method:", req.Method)
-		}
+	if err := srv.ListenAndServe(); err != sipnet.ErrServerClosed {
+		fmt.Println("serve error:", err)
 	}
 }
@@ -1,3 +1,3 @@
 module github.com/1lann/go-sip
 
-go 1.14
+go 1.18
@@ -15,6 +15,10 @@ import (
 // TODO: Place this in a configuration file
 var hostname = "localhost"
 
+// defaultExpires is the number of seconds a registration lasts if the
+// client does not specify one.
+const defaultExpires = 3600
+
 type authSession struct {
 	nonce   string
 	user    sipnet.User
@@ -47,28 +51,20 @@ func parseAuthHeader(header string) (sipnet.HeaderArgs, error) {
 	return sipnet.ParsePairs(header[7:]), nil
 }
 
-func requestAuthentication(r *sipnet.Request, conn *sipnet.Conn, from sipnet.User) {
-	resp := sipnet.NewResponse()
-
+func requestAuthentication(w sipnet.ResponseWriter, r *sipnet.Request,
+	from sipnet.User) {
+	// The Call-ID is guaranteed to be present by the listener's Validator.
 	callID := r.Header.Get("Call-ID")
-	if callID == "" {
-		resp.BadRequest(conn, r, "Missing required Call-ID header.")
-		return
-	}
-
 	nonce := generateNonce(32)
 
-	resp.StatusCode = sipnet.StatusUnauthorized
 	// No auth header, deny.
-	resp.Header.Set("From", from.String())
-	from.Arguments.Del("tag")
-	resp.Header.Set("To", from.String())
-
-	authArgs := make(sipnet.HeaderArgs)
-	authArgs.Set("realm", hostname)
-	authArgs.Set("qop", "auth")
-	authArgs.Set("nonce", nonce)
-	authArgs.Set("opaque", "")
+	resp := sipnet.NewResponseFor(r, sipnet.StatusUnauthorized, "")
+
+	var authArgs sipnet.HeaderArgs
+	authArgs.SetQuoted("realm", hostname)
+	authArgs.SetQuoted("qop", "auth")
+	authArgs.SetQuoted("nonce", nonce)
+	authArgs.SetQuoted("opaque", "")
 	authArgs.Set("stale", "FALSE")
 	authArgs.Set("algorithm", "MD5")
 	resp.Header.Set("WWW-Authenticate", "Digest "+authArgs.CommaString())
@@ -77,13 +73,12 @@ func requestAuthentication(r *sipnet.Request, conn *sipnet.Conn, from sipnet.Use
 	authSessions[callID] = authSession{
 		nonce:   nonce,
 		user:    from,
-		conn:    conn,
+		conn:    w.Conn(),
 		created: time.Now(),
 	}
 	authSessionMutex.Unlock()
 
-	resp.WriteTo(conn, r)
-	return
+	w.Respond(resp)
 }
 
 func md5Hex(data string) string {
@@ -91,31 +86,65 @@ func md5Hex(data string) string {
 	return hex.EncodeToString(sum[:])
 }
 
-func checkAuthorization(r *sipnet.Request, conn *sipnet.Conn,
-	authArgs sipnet.HeaderArgs, user sipnet.User) {
+// registrationExpires returns the number of seconds a registration is
+// requested for, from the expires parameter of the first contact or the
+// Expires header.
+func registrationExpires(h *sipnet.Header) (uint32, error) {
+	contacts, err := sipnet.ParseContacts(h)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(contacts) > 0 && !contacts[0].Wildcard {
+		expires, found, err := contacts[0].Expires()
+		if found || err != nil {
+			return expires, err
+		}
+	}
+
+	if value, found := h.First("Expires"); found {
+		return sipnet.ParseExpires(value)
+	}
+
+	return defaultExpires, nil
+}
+
+// badRequestReason returns the reason to respond with for a parse error,
+// using the header specific reason if there is one.
+func badRequestReason(err error, reason string) string {
+	var headerErr *sipnet.HeaderError
+	if errors.As(err, &headerErr) {
+		return headerErr.Reason()
+	}
+
+	return reason
+}
+
+func checkAuthorization(w sipnet.ResponseWriter, r *sipnet.Request,
+	authArgs sipnet.HeaderArgs, user sipnet.User, expires uint32) {
 	callID := r.Header.Get("Call-ID")
 	authSessionMutex.Lock()
 	session, found := authSessions[callID]
 	authSessionMutex.Unlock()
 	if !found {
-		requestAuthentication(r, conn, user)
+		requestAuthentication(w, r, user)
 		return
 	}
 
-	if authArgs.Get("username") != user.URI.Username {
-		requestAuthentication(r, conn, user)
+	if authArgs.Get("username") != user.URI.User {
+		requestAuthentication(w, r, user)
 		return
 	}
 
 	if authArgs.Get("nonce") != session.nonce {
-		requestAuthentication(r, conn, user)
+		requestAuthentication(w, r, user)
 		return
 	}
 
-	username := user.URI.Username
+	username := user.URI.User
 	account, found := accounts[username]
 	if !found {
-		requestAuthentication(r, conn, user)
+		requestAuthentication(w, r, user)
 		return
 	}
 
@@ -125,60 +154,55 @@ func checkAuthorization(r *sipnet.Request, conn *sipnet.Conn,
 		":" + authArgs.Get("cnonce") + ":auth:" + ha2)
 
 	if response != authArgs.Get("response") {
-		requestAuthentication(r, conn, user)
+		requestAuthentication(w, r, user)
 		return
 	}
 
-	if r.Header.Get("Expires") == "0" {
-		registeredUsersMutex.Lock()
-		delete(registeredUsers, username)
-		registeredUsersMutex.Unlock()
+	if expires == 0 {
+		unregisterUser(user.URI)
 		println("logged out " + username)
 	} else {
 		registerUser(session)
 		println("registered " + username)
 	}
 
-	resp := sipnet.NewResponse()
-	resp.StatusCode = sipnet.StatusOK
-	resp.Header.Set("From", user.String())
-
-	user.Arguments.Set("tag", generateNonce(5))
-	resp.Header.Set("To", user.String())
-	resp.WriteTo(conn, r)
-
-	return
+	w.WriteStatus(sipnet.StatusOK, "")
 }
 
 // HandleRegister handles REGISTER SIP requests.
-func HandleRegister(r *sipnet.Request, conn *sipnet.Conn) {
-	from, to, err := sipnet.ParseUserHeader(r.Header)
-	if err != nil {
-		resp := sipnet.NewResponse()
-		resp.BadRequest(conn, r, "Failed to parse From or To header.")
+func HandleRegister(w sipnet.ResponseWriter, r *sipnet.Request) {
+	withUsers(handleRegister)(w, r)
+}
+
+func handleRegister(w sipnet.ResponseWriter, r *sipnet.Request, from,
+	to sipnet.User) {
+	if !to.URI.AddressOfRecord().Equal(from.URI.AddressOfRecord()) {
+		w.WriteStatus(sipnet.StatusBadRequest,
+			"User in To and From fields do not match.")
 		return
 	}
 
-	if to.URI.UserDomain() != from.URI.UserDomain() {
-		resp := sipnet.NewResponse()
-		resp.BadRequest(conn, r, "User in To and From fields do not match.")
+	expires, err := registrationExpires(&r.Header)
+	if err != nil {
+		w.WriteStatus(sipnet.StatusBadRequest, badRequestReason(err,
+			"Failed to parse Contact or Expires header."))
 		return
 	}
 
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		requestAuthentication(r, conn, from)
+		requestAuthentication(w, r, from)
 		return
 	}
 
 	args, err := parseAuthHeader(authHeader)
 	if err != nil {
-		resp := sipnet.NewResponse()
-		resp.BadRequest(conn, r, "Failed to parse Authorization header.")
+		w.WriteStatus(sipnet.StatusBadRequest,
+			"Failed to parse Authorization header.")
 		return
 	}
 
-	checkAuthorization(r, conn, args, from)
+	checkAuthorization(w, r, args, from, expires)
 }
 
 func registrationJanitor() {
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/1lann/go-sip/sipnet"
+)
+
+// userHandler is a handler which is given the parsed From and To users of
+// the request.
+type userHandler func(w sipnet.ResponseWriter, r *sipnet.Request, from,
+	to sipnet.User)
+
+// withUsers returns a handler which parses the From and To headers of a
+// request for a userHandler, and responds with a 400 Bad Request if either
+// fails to be parsed.
+func withUsers(handler userHandler) sipnet.HandlerFunc {
+	return func(w sipnet.ResponseWriter, r *sipnet.Request) {
+		from, to, err := sipnet.ParseUserHeader(&r.Header)
+		if err != nil {
+			w.WriteStatus(sipnet.StatusBadRequest,
+				"Failed to parse From or To header.")
+			return
+		}
+
+		handler(w, r, from, to)
+	}
+}
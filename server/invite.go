@@ -1,7 +1,7 @@
 package server
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -9,38 +9,26 @@ import (
 	"github.com/1lann/go-sip/sipnet"
 )
 
-var errGiveUp = errors.New("server: give up")
-var errUnknownResponse = errors.New("server: unknown response")
+// maxCallDuration is the longest a call may last before it is torn down.
+const maxCallDuration = 4 * time.Hour
 
 // HandleInvite handles INVITE SIP requests and attempts to make a call.
-func HandleInvite(r *sipnet.Request, conn *sipnet.Conn) {
-	from, to, err := sipnet.ParseUserHeader(r.Header)
-	if err != nil {
-		resp := sipnet.NewResponse()
-		resp.BadRequest(conn, r, "Failed to parse From or To header.")
-		return
-	}
-
-	username := from.URI.Username
-
-	registeredUsersMutex.Lock()
-	user, found := registeredUsers[username]
-	registeredUsersMutex.Unlock()
+func HandleInvite(w sipnet.ResponseWriter, r *sipnet.Request) {
+	withUsers(handleInvite)(w, r)
+}
 
+func handleInvite(w sipnet.ResponseWriter, r *sipnet.Request, from,
+	to sipnet.User) {
+	conn := w.Conn()
+	user, found := findRegisteredUser(from.URI)
 	if !found || user.conn != conn {
-		resp := sipnet.NewResponse()
-		resp.StatusCode = sipnet.StatusForbidden
-		resp.Header.Set("Reason-Phrase", "Not registered.")
-		resp.WriteTo(conn, r)
+		w.WriteStatus(sipnet.StatusForbidden, "Not registered.")
 		return
 	}
 
-	recipient := to.URI.Username
-	recipientUser, found := registeredUsers[recipient]
+	recipientUser, found := findRegisteredUser(to.URI)
 	if !found {
-		resp := sipnet.NewResponse()
-		resp.StatusCode = sipnet.StatusNotFound
-		resp.WriteTo(conn, r)
+		w.WriteStatus(sipnet.StatusNotFound, "")
 		return
 	}
 
@@ -51,18 +39,40 @@ func HandleInvite(r *sipnet.Request, conn *sipnet.Conn) {
 
 	fmt.Println("calling " + recipientUser.username)
 
-	initiateCall(r, conn, recipientUser.conn)
+	ctx, cancel := context.WithTimeout(r.Context(), maxCallDuration)
+	defer cancel()
+	initiateCall(ctx, r, conn, recipientUser.conn)
 }
 
-func initiateCall(initialRequest *sipnet.Request,
+// initiateCall forwards the messages of a call between the caller and the
+// callee until the call ends, which is when the INVITE fails, a BYE is
+// answered, either connection fails, or ctx is done.
+func initiateCall(ctx context.Context, initialRequest *sipnet.Request,
 	from *sipnet.Conn, to *sipnet.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	from.Lock()
 	defer from.Unlock()
 	to.Lock()
 	defer to.Unlock()
 
 	trying(initialRequest, from)
-	initialRequest.WriteTo(to)
+	tx, err := to.SendRequest(initialRequest)
+	if err != nil {
+		fmt.Println("failed to forward invite:", err)
+		resp := sipnet.NewResponseFor(initialRequest,
+			sipnet.StatusServiceUnavailable, "")
+		resp.WriteTo(from, initialRequest)
+		return
+	}
+
+	// Terminating the transaction stops forwardResponses if the call ends
+	// before the callee answers.
+	defer tx.Terminate()
+
+	c := &call{end: cancel}
+	go c.forwardResponses(tx, from, to)
 
 	wg := new(sync.WaitGroup)
 
@@ -70,12 +80,18 @@ func initiateCall(initialRequest *sipnet.Request,
 
 	go func() {
 		defer wg.Done()
+		defer cancel()
 		var lastRequest *sipnet.Request
 		for {
-			read := from.Read()
+			read := from.ReadContext(ctx)
 			switch read.(type) {
 			case *sipnet.Request:
 				req := read.(*sipnet.Request)
+				if resp := c.receive(&c.caller, req); resp != nil {
+					resp.WriteTo(from, req)
+					break
+				}
+
 				fmt.Println("from --> to request, forwarding")
 				fmt.Println(req)
 				lastRequest = req
@@ -86,6 +102,7 @@ func initiateCall(initialRequest *sipnet.Request,
 				fmt.Println(resp)
 
 				resp.WriteTo(to, lastRequest)
+				c.endIfBye(resp)
 			case error:
 				err := read.(error)
 				fmt.Println("TODO: from error:", err)
@@ -96,17 +113,17 @@ func initiateCall(initialRequest *sipnet.Request,
 
 	go func() {
 		defer wg.Done()
+		defer cancel()
 		lastRequest := initialRequest
 		for {
-			read := to.Read()
+			read := to.ReadContext(ctx)
 			switch read.(type) {
 			case *sipnet.Request:
 				req := read.(*sipnet.Request)
 
 				if req.Method == sipnet.MethodOptions {
 					fmt.Println("responding with options")
-					resp := sipnet.NewResponse()
-					resp.StatusCode = sipnet.StatusOK
+					resp := sipnet.NewResponseFor(req, sipnet.StatusOK, "")
 					resp.Header.Set("Allow", "INVITE, ACK, CANCEL, OPTIONS, BYE")
 					resp.Header.Set("Accept", "application/sdp")
 					resp.Header.Set("Accept-Encoding", "gzip")
@@ -117,6 +134,11 @@ func initiateCall(initialRequest *sipnet.Request,
 					break
 				}
 
+				if resp := c.receive(&c.callee, req); resp != nil {
+					resp.WriteTo(to, req)
+					break
+				}
+
 				fmt.Println("to --> from request, forwarding")
 				fmt.Println(req)
 				lastRequest = req
@@ -133,6 +155,7 @@ func initiateCall(initialRequest *sipnet.Request,
 				fmt.Println(resp)
 
 				resp.WriteTo(from, lastRequest)
+				c.endIfBye(resp)
 			case error:
 				err := read.(error)
 				fmt.Println("TODO: from error:", err)
@@ -145,75 +168,107 @@ func initiateCall(initialRequest *sipnet.Request,
 }
 
 func trying(r *sipnet.Request, conn *sipnet.Conn) {
-	resp := sipnet.NewResponse()
-	resp.StatusCode = sipnet.StatusTrying
+	resp := sipnet.NewResponseFor(r, sipnet.StatusTrying, "")
 	resp.WriteTo(conn, r)
 }
 
-func waitResponse(conn *sipnet.Conn) (*sipnet.Response, error) {
-	resp := conn.Read()
-	switch resp.(type) {
-	case *sipnet.Response:
-		return resp.(*sipnet.Response), nil
-	case error:
-		return nil, resp.(error)
-	default:
-		return nil, errUnknownResponse
+// call tracks the dialogs of a call, so that requests within them which
+// are out of order are rejected rather than forwarded.
+type call struct {
+	mutex sync.Mutex
+
+	// caller is the dialog with the caller, in which the server is the UAS.
+	caller *sipnet.Dialog
+
+	// callee is the dialog with the callee, in which the server is the UAC.
+	callee *sipnet.Dialog
+
+	// end ends the call, stopping the forwarding of its messages.
+	end context.CancelFunc
+}
+
+// endIfBye ends the call once a final response to a BYE is forwarded.
+func (c *call) endIfBye(resp *sipnet.Response) {
+	if cseq, err := resp.CSeq(); err == nil &&
+		cseq.Method == sipnet.MethodBye && resp.IsFinal() {
+		c.end()
 	}
 }
 
-func makeUnreliableRequest(r *sipnet.Request, fromConn *sipnet.Conn,
-	toConn *sipnet.Conn) *sipnet.Response {
-	for {
-		receivedResponse := false
-		responseChannel := make(chan interface{})
+// receive checks a request against a dialog of the call, and returns the
+// response it must be rejected with, if any.
+func (c *call) receive(dialog **sipnet.Dialog,
+	req *sipnet.Request) *sipnet.Response {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-		go func() {
-			for i := 0; i < 10; i++ {
-				if receivedResponse {
-					return
-				}
+	if *dialog == nil || !(*dialog).Matches(req) {
+		return nil
+	}
 
-				err := r.WriteTo(toConn)
-				if err != nil {
-					fmt.Println("write error:", err)
-					responseChannel <- err
-				}
-				time.Sleep(time.Millisecond * 500)
-			}
-			responseChannel <- errGiveUp
-		}()
-
-		go func() {
-			responseChannel <- toConn.Read()
-		}()
-
-		resp := <-responseChannel
-		receivedResponse = true
-
-		switch resp.(type) {
-		case *sipnet.Response:
-			return resp.(*sipnet.Response)
-		case *sipnet.Request:
-			req := resp.(*sipnet.Request)
-
-			resp := sipnet.NewResponse()
-			resp.StatusCode = sipnet.StatusOK
-			resp.Header.Set("Allow", "INVITE, ACK, CANCEL, OPTIONS, BYE")
-			resp.Header.Set("Accept", "application/sdp")
-			resp.Header.Set("Accept-Encoding", "gzip")
-			resp.Header.Set("Accept-Language", "en")
-			resp.Header.Set("Content-Type", "application/sdp")
-			resp.Body = r.Body
-			resp.WriteTo(fromConn, req)
-
-			break
-		case error:
-			fmt.Println("received error response:", resp.(error))
-			return nil
-		default:
-			fmt.Println("received unknown response:", resp)
-			return nil
+	return (*dialog).ReceiveRequest(req)
+}
+
+// update creates or confirms the dialogs of the call with a response to the
+// INVITE. A response with a new To tag (from a forked INVITE) replaces an
+// early dialog.
+func (c *call) update(from, to *sipnet.Conn, invite *sipnet.Request,
+	resp *sipnet.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.callee != nil && c.callee.MatchesResponse(resp) {
+		c.callee.ReceiveResponse(resp)
+		if resp.IsSuccess() && c.caller != nil {
+			c.caller.Status = sipnet.DialogConfirmed
 		}
+		return
+	}
+
+	if c.callee != nil && c.callee.Status != sipnet.DialogEarly {
+		return
+	}
+
+	callee, err := sipnet.NewClientDialog(to, invite, resp)
+	if err != nil {
+		return
+	}
+
+	caller, err := sipnet.NewServerDialog(from, invite, resp)
+	if err != nil {
+		return
+	}
+
+	c.callee, c.caller = callee, caller
+}
+
+// forwardResponses forwards the responses to the INVITE back to the
+// caller, and responds with a timeout if the callee never responded. The
+// call is ended if the INVITE is not answered with a 2xx response.
+func (c *call) forwardResponses(tx *sipnet.ClientTransaction, from,
+	to *sipnet.Conn) {
+	answered := false
+	for resp := range tx.Responses() {
+		if resp.StatusCode == sipnet.StatusTrying {
+			continue
+		}
+
+		c.update(from, to, tx.Request, resp)
+		answered = answered || resp.IsSuccess()
+
+		fmt.Println("to --> from response, forwarding")
+		fmt.Println(resp)
+
+		resp.WriteTo(from, tx.Request)
+	}
+
+	if tx.Err() != nil {
+		resp := sipnet.NewResponseFor(tx.Request, sipnet.StatusRequestTimeout,
+			"")
+		resp.WriteTo(from, tx.Request)
+	}
+
+	if !answered {
+		c.end()
 	}
 }
@@ -8,25 +8,61 @@ import (
 
 type registeredUser struct {
 	username string
+	aor      sipnet.URI
 	conn     *sipnet.Conn
 }
 
-var registeredUsers = make(map[string]registeredUser)
+var registeredUsers []registeredUser
 var registeredUsersMutex = new(sync.Mutex)
 
-func registerUser(session authSession) {
+// findRegisteredUser returns the registered user whose address-of-record
+// matches the given URI.
+func findRegisteredUser(uri sipnet.URI) (registeredUser, bool) {
 	registeredUsersMutex.Lock()
 	defer registeredUsersMutex.Unlock()
 
-	username := session.user.URI.Username
-	if connected, found := registeredUsers[username]; found {
-		connected.conn.Close()
+	aor := uri.AddressOfRecord()
+	for _, user := range registeredUsers {
+		if user.aor.Equal(aor) {
+			return user, true
+		}
 	}
 
+	return registeredUser{}, false
+}
+
+func unregisterUser(uri sipnet.URI) {
+	registeredUsersMutex.Lock()
+	defer registeredUsersMutex.Unlock()
+
+	aor := uri.AddressOfRecord()
+	for i, user := range registeredUsers {
+		if user.aor.Equal(aor) {
+			registeredUsers = append(registeredUsers[:i:i],
+				registeredUsers[i+1:]...)
+			return
+		}
+	}
+}
+
+func registerUser(session authSession) {
+	registeredUsersMutex.Lock()
+	defer registeredUsersMutex.Unlock()
+
+	aor := session.user.URI.AddressOfRecord()
 	newUser := registeredUser{
-		username: username,
+		username: session.user.URI.User,
+		aor:      aor,
 		conn:     session.conn,
 	}
 
-	registeredUsers[username] = newUser
+	for i, connected := range registeredUsers {
+		if connected.aor.Equal(aor) {
+			connected.conn.Close()
+			registeredUsers[i] = newUser
+			return
+		}
+	}
+
+	registeredUsers = append(registeredUsers, newUser)
 }
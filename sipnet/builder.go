@@ -0,0 +1,299 @@
+package sipnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoLocalAddr is returned when building a request without a local
+// address, which is needed for its Via and Contact headers.
+var ErrNoLocalAddr = errors.New("sip: no local address")
+
+// DefaultMaxForwards is the Max-Forwards of requests built by a
+// RequestBuilder or DialogState, as recommended by RFC 3261 section 8.1.1.6.
+const DefaultMaxForwards = 70
+
+// RequestBuilder builds requests originated by a UAC outside of a dialog,
+// as described by RFC 3261 section 8.1.1. Requests built by the same
+// RequestBuilder share a Call-ID and From tag, and have increasing CSeqs,
+// which is what is expected of consecutive REGISTER requests.
+type RequestBuilder struct {
+	// From is the local identity. A random tag is added to the requests if
+	// it has none.
+	From User
+
+	// To is the remote identity. If its URI is empty, the target of the
+	// request is used.
+	To User
+
+	// LocalAddr is the local address of the transport the request is to be
+	// sent on, which is used for the sent-by of the Via and the Contact.
+	LocalAddr net.Addr
+
+	// Transport is the transport the request is to be sent on, such as
+	// "udp" or "tcp". If empty, the network of LocalAddr is used.
+	Transport string
+
+	// CallID is the Call-ID of the requests. A random Call-ID is generated
+	// if it is empty.
+	CallID string
+
+	// CSeq is the sequence number of the next request. If 0, it starts
+	// from 1.
+	CSeq uint32
+
+	// lastCSeq is the sequence number of the last request built other
+	// than ACK and CANCEL, or 0.
+	lastCSeq uint32
+
+	// fromTag is the tag generated for From if it has none.
+	fromTag string
+}
+
+// Build returns a new request with a method to a target, with a Via with a
+// new branch, From, To, Call-ID, CSeq, Max-Forwards and Contact headers.
+// ErrNoLocalAddr is returned if the builder has no LocalAddr.
+//
+// The sequence number is incremented for every method except ACK and
+// CANCEL, which reuse the sequence number of the last request built, as
+// they refer to it (RFC 3261 sections 9.1 and 17.1.1.3).
+func (b *RequestBuilder) Build(method string, target URI) (*Request, error) {
+	// The tag is added to a copy, so that b.From and the arguments it may
+	// share with the caller are not modified.
+	from := b.From
+	if !from.Arguments.Has("tag") {
+		if b.fromTag == "" {
+			tag, err := randomToken(8)
+			if err != nil {
+				return nil, err
+			}
+
+			b.fromTag = tag
+		}
+
+		from.Arguments = append(HeaderArgs(nil), from.Arguments...)
+		from.Arguments.Set("tag", b.fromTag)
+	}
+
+	if b.CallID == "" {
+		callID, err := randomToken(16)
+		if err != nil {
+			return nil, err
+		}
+
+		b.CallID = callID
+	}
+
+	if b.CSeq == 0 {
+		b.CSeq = 1
+	}
+
+	seq := b.CSeq
+	reuse := method == MethodAck || method == MethodCancel
+	if reuse && b.lastCSeq != 0 {
+		seq = b.lastCSeq
+	}
+
+	to := b.To
+	if to.URI.Scheme == "" {
+		to = User{URI: target}
+	}
+
+	r, err := newUACRequest(method, target, b.LocalAddr, b.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("From", from.String())
+	r.Header.Set("To", to.String())
+	r.Header.Set("Call-ID", b.CallID)
+	r.Header.Set("CSeq", CSeq{Seq: seq, Method: method}.String())
+	r.Header.Set("Contact", localContact(from.URI.User, b.LocalAddr,
+		b.Transport).String())
+	if !reuse {
+		b.lastCSeq = seq
+		b.CSeq++
+	}
+
+	return r, nil
+}
+
+// DialogState holds the state of a dialog which is needed to build requests
+// within it, as described by RFC 3261 section 12.2.1.1.
+type DialogState struct {
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+	LocalURI  URI
+	RemoteURI URI
+
+	// LocalCSeq is the sequence number of the last request sent within the
+	// dialog.
+	LocalCSeq uint32
+
+	// RemoteTarget is the URI from the Contact of the remote UA.
+	RemoteTarget URI
+
+	// RouteSet holds the URIs of the Record-Route of the dialog, in the
+	// order they are to be visited.
+	RouteSet []URI
+
+	// LocalAddr and Transport are the local address and transport the
+	// requests are to be sent on.
+	LocalAddr net.Addr
+	Transport string
+}
+
+// NewRequest returns a new request within the dialog. The local sequence
+// number is incremented for every method except ACK, which must use the
+// sequence number of the INVITE it acknowledges, and CANCEL.
+// ErrNoLocalAddr is returned if the dialog has no LocalAddr.
+func (d *DialogState) NewRequest(method string) (*Request, error) {
+	target, routes := d.target()
+	r, err := newUACRequest(method, target, d.LocalAddr, d.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if method != MethodAck && method != MethodCancel {
+		d.LocalCSeq++
+	}
+
+	for _, route := range routes {
+		r.Header.Add("Route", User{URI: route}.String())
+	}
+
+	from := User{URI: d.LocalURI}
+	if d.LocalTag != "" {
+		from.Arguments.Set("tag", d.LocalTag)
+	}
+
+	to := User{URI: d.RemoteURI}
+	if d.RemoteTag != "" {
+		to.Arguments.Set("tag", d.RemoteTag)
+	}
+
+	r.Header.Set("From", from.String())
+	r.Header.Set("To", to.String())
+	r.Header.Set("Call-ID", d.CallID)
+	r.Header.Set("CSeq", CSeq{Seq: d.LocalCSeq, Method: method}.String())
+	r.Header.Set("Contact", localContact(d.LocalURI.User, d.LocalAddr,
+		d.Transport).String())
+
+	return r, nil
+}
+
+// target returns the Request-URI and the Route header URIs of requests
+// within the dialog. If the first route is a strict router (it has no lr
+// parameter), it becomes the Request-URI and the remote target is placed at
+// the end of the routes, as described by RFC 3261 section 12.2.1.1.
+func (d *DialogState) target() (URI, []URI) {
+	if len(d.RouteSet) == 0 || d.RouteSet[0].Params.Has("lr") {
+		return d.RemoteTarget, d.RouteSet
+	}
+
+	target := d.RouteSet[0]
+	target.Params = nil
+	target.Headers = nil
+
+	routes := append([]URI(nil), d.RouteSet[1:]...)
+	return target, append(routes, d.RemoteTarget)
+}
+
+// NewBranch returns a new random branch parameter for a Via, which starts
+// with the RFC 3261 magic cookie. An error is returned if the system's
+// random number generator fails.
+func NewBranch() (string, error) {
+	token, err := randomToken(12)
+	if err != nil {
+		return "", err
+	}
+
+	return MagicCookie + token, nil
+}
+
+// newUACRequest returns a new request with a Via for the local address and
+// transport and a Max-Forwards header.
+func newUACRequest(method string, target URI, local net.Addr,
+	transport string) (*Request, error) {
+	if local == nil {
+		return nil, ErrNoLocalAddr
+	}
+
+	branch, err := NewBranch()
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRequest()
+	r.Method = method
+	r.URI = target
+
+	via := Via{
+		SIPVersion: SIPVersion,
+		Transport:  strings.ToUpper(transportOf(local, transport)),
+		Client:     addrURI(local).HostPort(),
+	}
+	via.Arguments.Set("branch", branch)
+	via.Arguments.Add("rport", "")
+
+	r.Header.Set("Via", via.String())
+	r.Header.Set("Max-Forwards", strconv.Itoa(DefaultMaxForwards))
+	return r, nil
+}
+
+// localContact returns the Contact of a UA with a user at a local address.
+func localContact(user string, local net.Addr, transport string) User {
+	uri := addrURI(local)
+	uri.Scheme = "sip"
+	uri.User = user
+	if transport := transportOf(local, transport); transport != "udp" {
+		uri.Params.Set("transport", transport)
+	}
+
+	return User{URI: uri}
+}
+
+// addrURI returns a URI with the host and port of an address.
+func addrURI(addr net.Addr) URI {
+	if addr == nil {
+		return URI{}
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return URI{Host: addr.String()}
+	}
+
+	uri := URI{Host: host}
+	uri.Port, _ = strconv.Atoi(port)
+	return uri
+}
+
+// transportOf returns the lower case transport, or the network of the
+// local address if transport is empty.
+func transportOf(local net.Addr, transport string) string {
+	if transport == "" && local != nil {
+		transport = strings.TrimRight(local.Network(), "46")
+	}
+
+	if transport == "" {
+		return "udp"
+	}
+
+	return strings.ToLower(transport)
+}
+
+// randomToken returns a random hex string of n bytes.
+func randomToken(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
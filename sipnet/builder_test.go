@@ -0,0 +1,66 @@
+package sipnet
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRequestBuilder(t *testing.T) {
+	from, err := ParseUser("<sip:alice@example.com>;x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &RequestBuilder{From: from}
+	target := URI{Scheme: "sip", Host: "example.com"}
+	if _, err := b.Build(MethodRegister, target); err != ErrNoLocalAddr {
+		t.Fatalf("got error %v, want ErrNoLocalAddr", err)
+	}
+
+	b.LocalAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5060}
+	first, err := b.Build(MethodRegister, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := b.Build(MethodRegister, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Header.Get("From") != second.Header.Get("From") ||
+		first.Header.Get("Call-ID") != second.Header.Get("Call-ID") ||
+		second.Header.Get("CSeq") != "2 REGISTER" {
+		t.Fatalf("requests do not share a From tag and Call-ID:\n%s\n%s",
+			first.Marshal(), second.Marshal())
+	}
+
+	// ACK and CANCEL reuse the sequence number of the request before them.
+	for _, method := range []string{MethodCancel, MethodAck} {
+		req, err := b.Build(method, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := req.Header.Get("CSeq"); got != "2 "+method {
+			t.Fatalf("got CSeq %q, want %q", got, "2 "+method)
+		}
+	}
+
+	if third, err := b.Build(MethodRegister, target); err != nil {
+		t.Fatal(err)
+	} else if third.Header.Get("CSeq") != "3 REGISTER" {
+		t.Fatalf("got CSeq %q, want 3 REGISTER", third.Header.Get("CSeq"))
+	}
+
+	if b.From.Arguments.Has("tag") || from.Arguments.Has("tag") {
+		t.Fatal("Build added the tag to the builder's From")
+	}
+
+	if !strings.HasPrefix(first.Header.Get("Via"),
+		"SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK") ||
+		first.Header.Get("Contact") != "<sip:alice@192.0.2.1:5060>" {
+		t.Fatalf("unexpected request %q", first.Marshal())
+	}
+}
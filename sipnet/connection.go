@@ -1,7 +1,10 @@
 package sipnet
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -23,22 +26,70 @@ type Conn struct {
 	ReadMessage chan interface{}
 	LastMessage time.Time
 
+	// Deprecated: Retransmitted requests are absorbed by the Listener's
+	// server transactions (see ServerTransaction), so ReceivedBranches is
+	// no longer populated. It is kept so that existing code compiles.
 	ReceivedBranches map[string]time.Time
-	BranchMutex      *sync.Mutex
+
+	// Deprecated: BranchMutex guards ReceivedBranches, which is no longer
+	// used.
+	BranchMutex *sync.Mutex
+
+	// sendMutex serializes direct writes by transactions, which are made
+	// from timer goroutines.
+	sendMutex sync.Mutex
+
+	// done is closed when the connection is closed.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Read reads either a *Request, a *Response, or an error from the connection.
 func (c *Conn) Read() interface{} {
-	if c.Closed {
+	return c.ReadContext(context.Background())
+}
+
+// ReadContext is like Read, but returns the context's error if ctx is done
+// before a message is received. io.EOF is returned once the connection is
+// closed.
+func (c *Conn) ReadContext(ctx context.Context) interface{} {
+	if c.isClosed() {
 		return io.EOF
 	}
 
-	msg, more := <-c.ReadMessage
-	if !more {
+	select {
+	case msg, more := <-c.ReadMessage:
+		if !more {
+			return io.EOF
+		}
+
+		return msg
+	case <-c.done:
 		return io.EOF
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	return msg
+// Done returns a channel which is closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// isClosed reports whether the connection is closed. Unlike reading
+// Closed, it is safe while the connection is being closed by another
+// goroutine.
+func (c *Conn) isClosed() bool {
+	if c.done == nil {
+		return c.Closed
+	}
+
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // Lock must be called to use Read(). It locks the connection to be read by
@@ -55,7 +106,7 @@ func (c *Conn) Unlock() {
 
 func (c *Conn) readRequest() (*Request, error) {
 	for {
-		if c.Closed {
+		if c.isClosed() {
 			return nil, io.EOF
 		}
 
@@ -63,8 +114,14 @@ func (c *Conn) readRequest() (*Request, error) {
 			time.Sleep(time.Second * 2)
 		}
 
-		msg, more := <-c.ReadMessage
-		if !more {
+		var msg interface{}
+		select {
+		case received, more := <-c.ReadMessage:
+			if !more {
+				return nil, io.EOF
+			}
+			msg = received
+		case <-c.done:
 			return nil, io.EOF
 		}
 
@@ -84,10 +141,15 @@ func (c *Conn) readRequest() (*Request, error) {
 	}
 }
 
+// udpReader reads the datagrams passed to the connection by the listener,
+// until the connection is closed. UdpReceiver is never closed, so that
+// writeReceivedUDP cannot send on a closed channel.
 func (c *Conn) udpReader() {
 	for {
-		received, more := <-c.UdpReceiver
-		if !more {
+		var received []byte
+		select {
+		case received = <-c.UdpReceiver:
+		case <-c.done:
 			return
 		}
 
@@ -98,71 +160,116 @@ func (c *Conn) udpReader() {
 			continue
 		}
 
-		rd := bytes.NewReader(received)
-		if bytes.Compare(received[:3], []byte("SIP")) == 0 {
-			resp, err := ReadResponse(rd)
-			if err != nil {
-				c.ReadMessage <- err
-				continue
-			}
-			c.ReadMessage <- resp
-			continue
-		}
-
-		req, err := ReadRequest(rd)
+		msg, err := c.parserConfig().readDatagram(received)
 		if err != nil {
-			c.ReadMessage <- err
+			c.reportMalformed(err, received)
 			continue
 		}
 
-		c.ReadMessage <- req
+		c.receive(msg)
 	}
 }
 
+// parserConfig returns the ParserConfig of the connection's listener, or
+// DefaultParserConfig.
+func (c *Conn) parserConfig() *ParserConfig {
+	if c.Listener != nil && c.Listener.config.ParserConfig != nil {
+		return c.Listener.config.ParserConfig
+	}
+
+	return DefaultParserConfig
+}
+
+// tcpReader reads messages from a stream based connection using a single
+// persistent reader, so that no data buffered past the end of one message
+// is lost. Malformed messages are reported without closing the
+// connection, as readStreamMessage resynchronizes on the next message.
 func (c *Conn) tcpReader() {
+	buf := bufio.NewReader(c.Conn)
 	for {
-		buf := make([]byte, 3)
-		_, err := io.ReadFull(c.Conn, buf)
-		if err != nil {
-			if err == io.ErrUnexpectedEOF || err == io.EOF {
-				c.Close()
-				return
-			}
+		msg, err := c.parserConfig().readStreamMessage(buf)
+		if err == errKeepAlive {
+			c.LastMessage = time.Now()
+			// Acknowledge keep alive
+			c.Conn.Write([]byte("\r\n"))
+			continue
+		} else if isUnframed(err) {
+			// The stream can no longer be framed.
+			c.reportMalformed(err, nil)
+			c.Close()
+			return
+		} else if errors.Is(err, ErrBadMessage) {
+			c.reportMalformed(err, nil)
+			continue
+		} else if err != nil {
+			c.Close()
+			return
 		}
 
-		rd := io.MultiReader(bytes.NewReader(buf), c.Conn)
+		c.LastMessage = time.Now()
+		c.receive(msg)
+	}
+}
 
-		if bytes.Compare(buf, []byte("SIP")) == 0 {
-			resp, err := ReadResponse(rd)
-			if err != nil {
-				c.ReadMessage <- err
-				continue
-			}
-			c.ReadMessage <- resp
-			continue
-		}
+// receive passes a received message to its transaction, or otherwise to
+// the reader of the connection.
+func (c *Conn) receive(msg interface{}) {
+	if c.Listener != nil && c.Listener.transactions.receive(c, msg) {
+		return
+	}
 
-		req, err := ReadRequest(rd)
-		if err != nil {
-			c.ReadMessage <- err
-			continue
-		}
+	select {
+	case c.ReadMessage <- msg:
+	case <-c.done:
+	}
+}
 
-		c.ReadMessage <- req
+// timers returns the Timers of the connection's listener, or
+// DefaultTimers.
+func (c *Conn) timers() *Timers {
+	if c.Listener != nil && c.Listener.config.Timers != nil {
+		return c.Listener.config.Timers
+	}
+
+	return DefaultTimers
+}
+
+// reportMalformed reports a message which failed to be parsed to the
+// listener's MalformedMessage handler, or otherwise to the reader of the
+// connection.
+func (c *Conn) reportMalformed(err error, data []byte) {
+	malformed := &MalformedMessageError{
+		Addr:      c.Address,
+		Transport: c.Transport,
+		Data:      data,
+		Err:       err,
+	}
+
+	if c.Listener != nil && c.Listener.config.MalformedMessage != nil {
+		c.Listener.config.MalformedMessage(malformed)
+		return
+	}
+
+	select {
+	case c.ReadMessage <- malformed:
+	case <-c.done:
 	}
 }
 
 func (c *Conn) writeReceivedUDP(b []byte) {
-	if c.Closed {
+	if c.isClosed() {
 		return
 	}
 
-	c.UdpReceiver <- b
+	select {
+	case c.UdpReceiver <- b:
+	case <-c.done:
+	}
 }
 
 // Write writes data to a buffer.
 func (c *Conn) Write(b []byte) (int, error) {
-	if c.Closed {
+	if c.isClosed() {
 		return 0, io.ErrClosedPipe
 	}
 
@@ -172,7 +279,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 // Flush flushes the buffered data to be written. In the case of using UDP,
 // the buffered data will be written in a single UDP packet.
 func (c *Conn) Flush() error {
-	if c.Closed {
+	if c.isClosed() {
 		return io.ErrClosedPipe
 	}
 
@@ -189,45 +296,57 @@ func (c *Conn) Flush() error {
 	return err
 }
 
-// Addr returns the network address of the connected UA.
-func (c *Conn) Addr() net.Addr {
-	return c.Address
-}
-
-// Close closes the connection.
-func (c *Conn) Close() error {
-	if c.Closed {
-		return nil
+// send writes a whole message directly to the connection, bypassing the
+// write buffer, so that it is safe to use from transaction timers.
+func (c *Conn) send(b []byte) error {
+	if c.isClosed() {
+		return io.ErrClosedPipe
 	}
 
-	c.Closed = true
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
 
 	if c.Transport == "udp" {
-		if c.Listener != nil {
-			c.Listener.udpPoolMutex.Lock()
-			delete(c.Listener.udpPool, c.Address.String())
-			c.Listener.udpPoolMutex.Unlock()
-		}
-		close(c.UdpReceiver)
-		return nil
+		_, err := c.Conn.(*net.UDPConn).WriteTo(b, c.Address)
+		return err
 	}
 
-	return c.Conn.Close()
+	_, err := c.Conn.Write(b)
+	return err
 }
 
-func (c *Conn) branchJanitor() {
-	for {
-		time.Sleep(time.Second * 10)
-		if c.Closed {
-			return
+// Addr returns the network address of the connected UA.
+func (c *Conn) Addr() net.Addr {
+	return c.Address
+}
+
+// Close closes the connection. It is safe to call Close more than once,
+// and from multiple goroutines.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.Closed = true
+		if c.done != nil {
+			close(c.done)
 		}
 
-		c.BranchMutex.Lock()
-		for branch, t := range c.ReceivedBranches {
-			if time.Now().Sub(t) > 30*time.Second {
-				delete(c.ReceivedBranches, branch)
+		if c.Transport == "udp" {
+			if c.Listener != nil {
+				c.Listener.udpPoolMutex.Lock()
+				delete(c.Listener.udpPool, c.Address.String())
+				c.Listener.udpPoolMutex.Unlock()
 			}
+			return
 		}
-		c.BranchMutex.Unlock()
-	}
+
+		if c.Listener != nil {
+			c.Listener.tcpConnsMutex.Lock()
+			delete(c.Listener.tcpConns, c)
+			c.Listener.tcpConnsMutex.Unlock()
+		}
+
+		err = c.Conn.Close()
+	})
+
+	return err
 }
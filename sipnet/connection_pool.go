@@ -8,30 +8,42 @@ import (
 	"time"
 )
 
+// getUDPConnFromPool returns the connection with a UDP address, creating it
+// if needed. Once the listener is closed, a new connection is returned
+// already closed, so that Close does not miss it.
 func (l *Listener) getUDPConnFromPool(address net.Addr) *Conn {
 	l.udpPoolMutex.Lock()
 	defer l.udpPoolMutex.Unlock()
 	conn, found := l.udpPool[address.String()]
 	if !found {
 		conn = &Conn{
-			Transport:        "udp",
-			Listener:         l,
-			Conn:             l.udpListener,
-			Address:          address,
-			UdpReceiver:      make(chan []byte),
-			Closed:           false,
-			Locked:           false,
-			WriteBuffer:      new(bytes.Buffer),
-			ReadMessage:      make(chan interface{}),
-			LastMessage:      time.Now(),
+			Transport:   "udp",
+			Listener:    l,
+			Conn:        l.udpListener,
+			Address:     address,
+			UdpReceiver: make(chan []byte),
+			Closed:      false,
+			Locked:      false,
+			WriteBuffer: new(bytes.Buffer),
+			ReadMessage: make(chan interface{}),
+			LastMessage: time.Now(),
+			done:        make(chan struct{}),
+
 			ReceivedBranches: make(map[string]time.Time),
 			BranchMutex:      new(sync.Mutex),
 		}
 
+		if l.isClosed() {
+			conn.closeOnce.Do(func() {
+				conn.Closed = true
+				close(conn.done)
+			})
+			return conn
+		}
+
 		l.udpPool[address.String()] = conn
 
 		go conn.udpReader()
-		go conn.branchJanitor()
 		go l.readRequests(conn)
 	}
 
@@ -40,33 +52,50 @@ func (l *Listener) getUDPConnFromPool(address net.Addr) *Conn {
 
 func (l *Listener) registerTCPConn(netConn net.Conn) {
 	conn := &Conn{
-		Transport:        "tcp",
-		Listener:         l,
-		Conn:             netConn,
-		Address:          netConn.RemoteAddr(),
-		UdpReceiver:      nil,
-		Closed:           false,
-		Locked:           false,
-		WriteBuffer:      new(bytes.Buffer),
-		ReadMessage:      make(chan interface{}),
-		LastMessage:      time.Time{},
+		Transport:   "tcp",
+		Listener:    l,
+		Conn:        netConn,
+		Address:     netConn.RemoteAddr(),
+		UdpReceiver: nil,
+		Closed:      false,
+		Locked:      false,
+		WriteBuffer: new(bytes.Buffer),
+		ReadMessage: make(chan interface{}),
+		LastMessage: time.Time{},
+		done:        make(chan struct{}),
+
 		ReceivedBranches: make(map[string]time.Time),
 		BranchMutex:      new(sync.Mutex),
 	}
 
+	l.tcpConnsMutex.Lock()
+	if l.isClosed() {
+		l.tcpConnsMutex.Unlock()
+		netConn.Close()
+		return
+	}
+	l.tcpConns[conn] = struct{}{}
+	l.tcpConnsMutex.Unlock()
+
 	go conn.tcpReader()
-	go conn.branchJanitor()
 	go l.readRequests(conn)
 }
 
 func (l *Listener) readRequests(conn *Conn) {
 	for {
 		req, err := conn.readRequest()
+		if req != nil && !l.validRequest(conn, req) {
+			continue
+		}
 
-		l.requestChannel <- requestPackage{
+		select {
+		case l.requestChannel <- requestPackage{
 			conn: conn,
 			req:  req,
 			err:  err,
+		}:
+		case <-l.done:
+			return
 		}
 
 		if err == io.EOF {
@@ -75,9 +104,36 @@ func (l *Listener) readRequests(conn *Conn) {
 	}
 }
 
+// validRequest returns whether or not a request passes the listener's
+// Validator. Invalid requests are responded to, except for ACKs which
+// cannot be responded to.
+func (l *Listener) validRequest(conn *Conn, req *Request) bool {
+	validator := l.config.Validator
+	if validator == nil {
+		validator = DefaultValidator
+	}
+
+	resp := validator.Validate(req)
+	if resp == nil {
+		return true
+	}
+
+	if req.Method != MethodAck {
+		resp.WriteTo(conn, req)
+	}
+
+	return false
+}
+
+// udpJanitor closes UDP connections which have been idle for 30 seconds,
+// until the listener is closed.
 func (l *Listener) udpJanitor() {
 	for {
-		time.Sleep(time.Second * 10)
+		select {
+		case <-time.After(time.Second * 10):
+		case <-l.done:
+			return
+		}
 
 		var markClose []*Conn
 		l.udpPoolMutex.Lock()
@@ -0,0 +1,122 @@
+package sipnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnCloseWhileReceiving(t *testing.T) {
+	// Without a reader, the datagrams block until the connection is
+	// closed, which must drop them rather than send on a closed channel.
+	conn := &Conn{
+		Transport:   "udp",
+		UdpReceiver: make(chan []byte),
+		done:        make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.writeReceivedUDP([]byte("\r\n\r\n"))
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+	wg.Wait()
+}
+
+func TestListenerClose(t *testing.T) {
+	l, peer := newTestPeer(t)
+	udp := l.getUDPConnFromPool(peer.LocalAddr())
+
+	stream, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	options := testRequest(MethodOptions)
+	options.Header.Set("Via", "SIP/2.0/TCP 127.0.0.1;branch="+MagicCookie+
+		testToken(12))
+	options.Header.Set("Content-Length", "0")
+	if _, err := stream.Write(options.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, tcp, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+	for _, conn := range []*Conn{udp, tcp} {
+		select {
+		case <-conn.Done():
+		case <-time.After(testWait):
+			t.Fatalf("%s connection was not closed", conn.Transport)
+		}
+	}
+
+	// The TCP connection is closed on the wire too.
+	stream.SetReadDeadline(time.Now().Add(testWait))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+
+	// Connections made after Close are closed straight away.
+	if late := l.getUDPConnFromPool(stream.LocalAddr()); !late.isClosed() {
+		t.Fatal("connection made after Close is open")
+	}
+}
+
+func TestListenerMalformedMessage(t *testing.T) {
+	malformed := make(chan *MalformedMessageError, 1)
+	l, err := (&ListenConfig{
+		ParserConfig: &ParserConfig{Strict: true},
+		MalformedMessage: func(err *MalformedMessageError) {
+			malformed <- err
+		},
+	}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	data := "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 127.0.0.1;branch=z9hG4bK1\r\n" +
+		"No colon\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	peer.WriteTo([]byte(data), l.udpListener.LocalAddr())
+
+	var got *MalformedMessageError
+	select {
+	case got = <-malformed:
+	case <-time.After(testWait):
+		t.Fatal("MalformedMessage was not called")
+	}
+
+	if string(got.Data) != data || got.Transport != "udp" ||
+		got.Addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("got %q from %s %v, want the datagram from udp %v",
+			got.Data, got.Transport, got.Addr, peer.LocalAddr())
+	}
+
+	var parseErr *ParseError
+	if !errors.As(got, &parseErr) || parseErr.Line != 3 ||
+		parseErr.Header != "No" {
+		t.Fatalf("got error %v, want a ParseError at line 3", got.Err)
+	}
+}
@@ -2,6 +2,7 @@
 package sipnet
 
 import (
+	"context"
 	"errors"
 	"net"
 	"time"
@@ -18,21 +19,23 @@ var ErrInvalidTransport = errors.New("sip: invalid transport")
 // After dialling, you should use ReadResponse to read from the connection,
 // and Request.WriteTo to write requests to the connection.
 func Dial(addr, transport string) (net.Conn, error) {
-	if transport == "tcp" {
-		conn, err := net.DialTimeout("tcp", addr, time.Second*10)
-		if err != nil {
-			return nil, err
-		}
-
-		return conn, nil
-	} else if transport == "udp" {
-		conn, err := net.Dial("udp", addr)
-		if err != nil {
-			return nil, err
-		}
+	return DialContext(context.Background(), addr, transport)
+}
 
-		return conn, nil
-	} else {
+// DialContext is like Dial, but the connection attempt is abandoned if ctx
+// is cancelled before it completes. TCP connection attempts also time out
+// after 10 seconds, as with Dial. Once connected, the context has no effect
+// on the connection.
+func DialContext(ctx context.Context, addr, transport string) (net.Conn,
+	error) {
+	if transport != "tcp" && transport != "udp" {
 		return nil, ErrInvalidTransport
 	}
+
+	var dialer net.Dialer
+	if transport == "tcp" {
+		dialer.Timeout = time.Second * 10
+	}
+
+	return dialer.DialContext(ctx, transport, addr)
 }
@@ -0,0 +1,386 @@
+package sipnet
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ErrNotDialogCreating is returned when creating a dialog from a request
+// and response which do not create a dialog.
+var ErrNotDialogCreating = errors.New("sip: message does not create a dialog")
+
+// DialogStatus is the state of a dialog.
+type DialogStatus int
+
+// The states of a dialog (RFC 3261 section 12).
+const (
+	// DialogEarly is the state of a dialog created by a provisional
+	// response.
+	DialogEarly DialogStatus = iota
+
+	// DialogConfirmed is the state of a dialog created or confirmed by a
+	// 2xx response.
+	DialogConfirmed
+
+	// DialogTerminated is the state of a dialog which ended, either with a
+	// BYE or a failure response.
+	DialogTerminated
+)
+
+// String returns the name of the state.
+func (s DialogStatus) String() string {
+	switch s {
+	case DialogEarly:
+		return "early"
+	case DialogConfirmed:
+		return "confirmed"
+	case DialogTerminated:
+		return "terminated"
+	}
+
+	return "DialogStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Dialog represents a peer-to-peer relationship between two UAs, as
+// described by RFC 3261 section 12. It tracks the DialogState needed to
+// build requests within the dialog, the remote sequence number, and the
+// state of the dialog. A Dialog is not safe for concurrent use.
+type Dialog struct {
+	DialogState
+
+	// RemoteCSeq is the sequence number of the last request received
+	// within the dialog, or 0 if none has been received.
+	RemoteCSeq uint32
+
+	// Status is the state of the dialog. Terminate should be used to end
+	// the dialog, so that its contexts are cancelled.
+	Status DialogStatus
+
+	// done is allocated by the constructors, or under doneMutex for
+	// dialogs which are not.
+	done      chan struct{}
+	doneMutex sync.Mutex
+	doneOnce  sync.Once
+}
+
+// NewClientDialog returns the dialog created by a request sent by a UAC and
+// a provisional (with a To tag) or 2xx response to it, as described by
+// RFC 3261 section 12.1.2. If conn is not nil, its local address and
+// transport are used for requests within the dialog.
+func NewClientDialog(conn *Conn, req *Request, resp *Response) (*Dialog,
+	error) {
+	from, to, err := dialogUsers(req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	cseq, err := ParseCSeq(req.Header.Get("CSeq"))
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := ParseRoutes(&resp.Header, "Record-Route")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dialog{
+		DialogState: DialogState{
+			CallID:    req.Header.Get("Call-ID"),
+			LocalTag:  from.Arguments.Get("tag"),
+			RemoteTag: to.Arguments.Get("tag"),
+			LocalURI:  from.URI,
+			RemoteURI: to.URI,
+			LocalCSeq: cseq.Seq,
+			RouteSet:  reverseRoutes(routes),
+		},
+		Status: dialogStatus(resp),
+		done:   make(chan struct{}),
+	}
+
+	d.setRemoteTarget(&resp.Header)
+	d.setConn(conn)
+	return d, nil
+}
+
+// NewServerDialog returns the dialog created by a request received by a UAS
+// and a provisional or 2xx response sent to it, as described by RFC 3261
+// section 12.1.1. The response should be built with NewResponseFor, so that
+// it has a To tag. If conn is not nil, its local address and transport are
+// used for requests within the dialog.
+func NewServerDialog(conn *Conn, req *Request, resp *Response) (*Dialog,
+	error) {
+	from, to, err := dialogUsers(req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	cseq, err := ParseCSeq(req.Header.Get("CSeq"))
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := ParseRoutes(&req.Header, "Record-Route")
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dialog{
+		DialogState: DialogState{
+			CallID:    req.Header.Get("Call-ID"),
+			LocalTag:  to.Arguments.Get("tag"),
+			RemoteTag: from.Arguments.Get("tag"),
+			LocalURI:  to.URI,
+			RemoteURI: from.URI,
+			RouteSet:  routeURIs(routes),
+		},
+		RemoteCSeq: cseq.Seq,
+		Status:     dialogStatus(resp),
+		done:       make(chan struct{}),
+	}
+
+	d.setRemoteTarget(&req.Header)
+	d.setConn(conn)
+	return d, nil
+}
+
+// dialogUsers checks that a request and response create a dialog, and
+// returns the From of the request and the To of the response.
+func dialogUsers(req *Request, resp *Response) (User, User, error) {
+	if !isDialogCreating(req.Method) || resp.StatusCode <= StatusTrying ||
+		resp.StatusCode >= 300 {
+		return User{}, User{}, ErrNotDialogCreating
+	}
+
+	from, err := ParseUser(req.Header.Get("From"))
+	if err != nil {
+		return User{}, User{}, err
+	}
+
+	to, err := ParseUser(resp.Header.Get("To"))
+	if err != nil {
+		return User{}, User{}, err
+	}
+
+	if !to.Arguments.Has("tag") {
+		return User{}, User{}, ErrNotDialogCreating
+	}
+
+	return from, to, nil
+}
+
+func dialogStatus(resp *Response) DialogStatus {
+	if resp.IsSuccess() {
+		return DialogConfirmed
+	}
+
+	return DialogEarly
+}
+
+func routeURIs(routes []User) []URI {
+	uris := make([]URI, len(routes))
+	for i, route := range routes {
+		uris[i] = route.URI
+	}
+
+	return uris
+}
+
+// reverseRoutes returns the URIs of a Record-Route in reverse order, which
+// is the route set of a UAC.
+func reverseRoutes(routes []User) []URI {
+	uris := routeURIs(routes)
+	for i, j := 0, len(uris)-1; i < j; i, j = i+1, j-1 {
+		uris[i], uris[j] = uris[j], uris[i]
+	}
+
+	return uris
+}
+
+// setRemoteTarget sets the remote target to the first Contact of a header,
+// if it has one.
+func (d *Dialog) setRemoteTarget(h *Header) {
+	contacts, err := ParseContacts(h)
+	if err == nil && len(contacts) > 0 && !contacts[0].Wildcard {
+		d.RemoteTarget = contacts[0].URI
+	}
+}
+
+func (d *Dialog) setConn(conn *Conn) {
+	if conn == nil {
+		return
+	}
+
+	d.Transport = conn.Transport
+	if conn.Conn != nil {
+		d.LocalAddr = conn.Conn.LocalAddr()
+	}
+}
+
+// Matches reports whether a request received by the local UA belongs to
+// the dialog, which is when its Call-ID matches, its To tag is the local
+// tag, and its From tag is the remote tag.
+func (d *Dialog) Matches(req *Request) bool {
+	from, err := ParseUser(req.Header.Get("From"))
+	if err != nil {
+		return false
+	}
+
+	to, err := ParseUser(req.Header.Get("To"))
+	if err != nil {
+		return false
+	}
+
+	return req.Header.Get("Call-ID") == d.CallID &&
+		to.Arguments.Get("tag") == d.LocalTag &&
+		from.Arguments.Get("tag") == d.RemoteTag
+}
+
+// MatchesResponse reports whether a response received by the local UA
+// belongs to the dialog. Responses in an early dialog may come from other
+// UAS which forked the request, so they are matched by their To tag.
+func (d *Dialog) MatchesResponse(resp *Response) bool {
+	from, err := ParseUser(resp.Header.Get("From"))
+	if err != nil {
+		return false
+	}
+
+	to, err := ParseUser(resp.Header.Get("To"))
+	if err != nil {
+		return false
+	}
+
+	return resp.Header.Get("Call-ID") == d.CallID &&
+		from.Arguments.Get("tag") == d.LocalTag &&
+		to.Arguments.Get("tag") == d.RemoteTag
+}
+
+// ReceiveRequest updates the dialog with a request received within it, as
+// described by RFC 3261 section 12.2.2. A request with a sequence number
+// lower than the remote sequence number is out of order, and the 500
+// response it must be rejected with is returned. Otherwise, nil is
+// returned, the remote target is refreshed by INVITE and UPDATE requests,
+// and the dialog is terminated by BYE.
+func (d *Dialog) ReceiveRequest(req *Request) *Response {
+	cseq, err := ParseCSeq(req.Header.Get("CSeq"))
+	if err != nil {
+		return badRequest(req, err)
+	}
+
+	// ACK and CANCEL have the sequence number of the request they are
+	// for.
+	if req.Method != MethodAck && req.Method != MethodCancel {
+		if d.RemoteCSeq != 0 && cseq.Seq < d.RemoteCSeq {
+			return NewResponseFor(req, StatusServerInternalError,
+				"CSeq out of order")
+		}
+
+		d.RemoteCSeq = cseq.Seq
+	}
+
+	switch req.Method {
+	case MethodInvite, MethodUpdate:
+		d.setRemoteTarget(&req.Header)
+	case MethodBye:
+		d.Terminate()
+	}
+
+	return nil
+}
+
+// ReceiveResponse updates the dialog with a response received to a
+// request sent within it, or to the request which created it. A 2xx
+// response confirms an early dialog, recomputing its route set (RFC 3261
+// section 12.1.2). A failure response to the request which created an
+// early dialog, or a 481 or 408 response to any request, terminates the
+// dialog (section 12.2.1.2). 2xx responses to INVITE and UPDATE refresh
+// the remote target.
+func (d *Dialog) ReceiveResponse(resp *Response) {
+	cseq, err := ParseCSeq(resp.Header.Get("CSeq"))
+	if err != nil {
+		return
+	}
+
+	switch {
+	case resp.StatusCode == StatusCallTransactionDoesNotExist ||
+		resp.StatusCode == StatusRequestTimeout:
+		d.Terminate()
+	case d.Status == DialogEarly && resp.IsSuccess():
+		if routes, err := ParseRoutes(&resp.Header,
+			"Record-Route"); err == nil {
+			d.RouteSet = reverseRoutes(routes)
+		}
+
+		d.Status = DialogConfirmed
+		d.setRemoteTarget(&resp.Header)
+	case d.Status == DialogEarly && resp.StatusCode >= 300 &&
+		isDialogCreating(cseq.Method):
+		d.Terminate()
+	case resp.IsSuccess() && (cseq.Method == MethodInvite ||
+		cseq.Method == MethodUpdate):
+		d.setRemoteTarget(&resp.Header)
+	}
+}
+
+// Terminate ends the dialog, and cancels the contexts returned by Context.
+func (d *Dialog) Terminate() {
+	d.Status = DialogTerminated
+	d.doneOnce.Do(func() {
+		close(d.doneChan())
+	})
+}
+
+// Context returns a context derived from parent which is cancelled when
+// the dialog is terminated, such as by a BYE. It can be used to bound the
+// work done for a call, such as by the handler of the INVITE which created
+// the dialog.
+func (d *Dialog) Context(parent context.Context) (context.Context,
+	context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	done := d.doneChan()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+func (d *Dialog) doneChan() chan struct{} {
+	d.doneMutex.Lock()
+	defer d.doneMutex.Unlock()
+
+	if d.done == nil {
+		d.done = make(chan struct{})
+	}
+
+	return d.done
+}
+
+// NewAck returns the ACK for a 2xx response to an INVITE sent within the
+// dialog, which has the sequence number of the INVITE (RFC 3261 section
+// 13.2.2.4). Unlike NewRequest, it does not increment the local sequence
+// number.
+func (d *Dialog) NewAck(invite *Request) (*Request, error) {
+	ack, err := d.DialogState.NewRequest(MethodAck)
+	if err != nil {
+		return nil, err
+	}
+
+	if cseq, err := ParseCSeq(invite.Header.Get("CSeq")); err == nil {
+		ack.Header.Set("CSeq", CSeq{Seq: cseq.Seq, Method: MethodAck}.String())
+	}
+
+	for _, key := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, value := range invite.Header.Values(key) {
+			ack.Header.Add(key, value)
+		}
+	}
+
+	return ack, nil
+}
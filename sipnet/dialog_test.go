@@ -0,0 +1,167 @@
+package sipnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDialogInvite returns an INVITE which passed through two proxies, and
+// a 180 response to it from the UAS.
+func testDialogInvite() (*Request, *Response) {
+	invite := testRequest(MethodInvite)
+	invite.Header.Set("Contact", "<sip:alice@192.0.2.1>")
+	invite.Header.Add("Record-Route", "<sip:p2.example.com;lr>")
+	invite.Header.Add("Record-Route", "<sip:p1.example.com;lr>")
+
+	ringing := NewResponseFor(invite, StatusRinging, "")
+	ringing.Header.Set("Contact", "<sip:bob@192.0.2.2>")
+	return invite, ringing
+}
+
+func TestClientDialog(t *testing.T) {
+	invite, ringing := testDialogInvite()
+	d, err := NewClientDialog(nil, invite, ringing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Status != DialogEarly || d.LocalTag != "1" ||
+		d.RemoteTag != invite.localTag() || d.LocalCSeq != 1 {
+		t.Fatalf("unexpected dialog %+v", d)
+	}
+
+	// Another UAS receiving the same forked INVITE picks a different tag.
+	forked := *invite
+	forked.toTag = ""
+	if forked.localTag() == d.RemoteTag {
+		t.Fatal("forked INVITE got the same To tag")
+	}
+
+	// The route set of a UAC is the reverse of the Record-Route.
+	if len(d.RouteSet) != 2 || d.RouteSet[0].Host != "p1.example.com" {
+		t.Fatalf("unexpected route set %v", d.RouteSet)
+	}
+
+	ok := NewResponseFor(invite, StatusOK, "")
+	ok.Header.Set("Contact", "<sip:bob@192.0.2.3>")
+	if !d.MatchesResponse(ok) {
+		t.Fatal("2xx does not match the dialog")
+	}
+
+	d.ReceiveResponse(ok)
+	if d.Status != DialogConfirmed || d.RemoteTarget.Host != "192.0.2.3" {
+		t.Fatalf("2xx did not confirm the dialog: %+v", d)
+	}
+
+	if _, err := d.NewAck(invite); err != ErrNoLocalAddr {
+		t.Fatalf("got error %v, want ErrNoLocalAddr", err)
+	}
+
+	d.LocalAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5060}
+	ack, err := d.NewAck(invite)
+	if err != nil || ack.Header.Get("CSeq") != "1 ACK" || ack.URI.Host != "192.0.2.3" ||
+		ack.Header.Get("Route") != "<sip:p1.example.com;lr>" {
+		t.Fatalf("unexpected ACK %q", ack.Marshal())
+	}
+
+	bye, err := d.NewRequest(MethodBye)
+	if err != nil || bye.Header.Get("CSeq") != "2 BYE" {
+		t.Fatalf("got CSeq %q, want 2 BYE", bye.Header.Get("CSeq"))
+	}
+
+	d.ReceiveResponse(NewResponseFor(bye, StatusCallTransactionDoesNotExist, ""))
+	if d.Status != DialogTerminated {
+		t.Fatal("481 did not terminate the dialog")
+	}
+}
+
+func TestServerDialog(t *testing.T) {
+	invite, ringing := testDialogInvite()
+	d, err := NewServerDialog(nil, invite, ringing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.RemoteCSeq != 1 || d.RemoteTarget.Host != "192.0.2.1" ||
+		len(d.RouteSet) != 2 || d.RouteSet[0].Host != "p2.example.com" {
+		t.Fatalf("unexpected dialog %+v", d)
+	}
+
+	// A request from the remote UA has the tags swapped.
+	update := testRequest(MethodUpdate)
+	update.Header = invite.Header.Clone()
+	update.Header.Set("To", ringing.Header.Get("To"))
+	update.Header.Set("CSeq", "3 UPDATE")
+	update.Header.Set("Contact", "<sip:alice@192.0.2.4>")
+	if !d.Matches(update) {
+		t.Fatal("UPDATE does not match the dialog")
+	}
+
+	if resp := d.ReceiveRequest(update); resp != nil {
+		t.Fatalf("UPDATE rejected with %d", resp.StatusCode)
+	}
+
+	if d.RemoteCSeq != 3 || d.RemoteTarget.Host != "192.0.2.4" {
+		t.Fatalf("UPDATE did not refresh the dialog: %+v", d)
+	}
+
+	ctx, cancel := d.Context(context.Background())
+	defer cancel()
+
+	info := update
+	info.Method = MethodInfo
+	info.Header.Set("CSeq", "2 INFO")
+	if resp := d.ReceiveRequest(info); resp == nil ||
+		resp.StatusCode != StatusServerInternalError {
+		t.Fatalf("out of order INFO got %v, want 500", resp)
+	}
+
+	bye := update
+	bye.Method = MethodBye
+	bye.Header.Set("CSeq", "4 BYE")
+	if resp := d.ReceiveRequest(bye); resp != nil ||
+		d.Status != DialogTerminated {
+		t.Fatalf("BYE got %v, dialog %v", resp, d.Status)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("BYE did not cancel the dialog context")
+	}
+
+	if _, err := NewServerDialog(nil, testRequest(MethodOptions),
+		ringing); err != ErrNotDialogCreating {
+		t.Fatalf("got error %v, want ErrNotDialogCreating", err)
+	}
+}
+
+func TestDialogTerminate(t *testing.T) {
+	// A dialog which was not made by a constructor allocates its done
+	// channel on first use, which may be from several goroutines.
+	d := &Dialog{Status: DialogConfirmed}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := d.Context(context.Background())
+			defer cancel()
+			<-ctx.Done()
+		}()
+	}
+
+	ctx, cancel := d.Context(context.Background())
+	defer cancel()
+	d.Terminate()
+	wg.Wait()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Terminate did not cancel the dialog context")
+	}
+}
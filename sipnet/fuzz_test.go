@@ -0,0 +1,356 @@
+package sipnet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// fuzzMessages are the seed corpus of the message fuzz targets.
+var fuzzMessages = []string{
+	"INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP pc33.example.com;branch=z9hG4bK776asdhds\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: Bob <sip:bob@example.com>\r\n" +
+		"From: Alice <sip:alice@example.com>;tag=1928301774\r\n" +
+		"Call-ID: a84b4c76e66710@pc33.example.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sip:alice@pc33.example.com>\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 4\r\n\r\nv=0\n",
+	"SIP/2.0 180 Ringing\r\n" +
+		"v: SIP/2.0/TCP 192.0.2.1;branch=z9hG4bK1;received=192.0.2.2\r\n" +
+		"t: <sip:bob@example.com>;tag=a6c85cf\r\n" +
+		"f: <sip:alice@example.com>;tag=1928301774\r\n" +
+		"i: a84b4c76e66710\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"l: 0\r\n\r\n",
+	"REGISTER sips:example.com SIP/2.0\r\n" +
+		"Subject: folded\r\n line\r\n\r\n",
+}
+
+func FuzzReadRequest(f *testing.F) {
+	for _, msg := range fuzzMessages {
+		f.Add([]byte(msg))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, config := range []*ParserConfig{
+			DefaultParserConfig, {Strict: true},
+		} {
+			req, err := config.ReadRequest(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+
+			// A marshalled request must be read back unchanged.
+			out := req.Marshal()
+			again, err := ReadRequest(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("failed to read back %q: %v", out, err)
+			}
+
+			if again := again.Marshal(); !bytes.Equal(out, again) {
+				t.Fatalf("round trip changed %q to %q", out, again)
+			}
+		}
+	})
+}
+
+func FuzzReadResponse(f *testing.F) {
+	for _, msg := range fuzzMessages {
+		f.Add([]byte(msg))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := ReadResponse(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		out := resp.Marshal()
+		again, err := ReadResponse(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to read back %q: %v", out, err)
+		}
+
+		if again := again.Marshal(); !bytes.Equal(out, again) {
+			t.Fatalf("round trip changed %q to %q", out, again)
+		}
+	})
+}
+
+func FuzzReadDatagram(f *testing.F) {
+	for _, msg := range fuzzMessages {
+		f.Add([]byte(msg))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := DefaultParserConfig.readDatagram(data)
+		if err != nil {
+			return
+		}
+
+		if req, ok := msg.(*Request); ok {
+			DefaultValidator.Validate(req)
+		}
+	})
+}
+
+func FuzzParseURI(f *testing.F) {
+	for _, seed := range []string{
+		"sip:alice@example.com",
+		"sips:alice:secret@[2001:db8::1]:5061;transport=tcp;lr?subject=x&h=%20",
+		"sip:%61lice@example.com;user=phone",
+		"tel:+1-201-555-0123;ext=22",
+		"mailto:alice@example.com",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		u, err := ParseURI(str)
+		if err != nil {
+			return
+		}
+
+		out := u.String()
+		again, err := ParseURI(out)
+		if err != nil {
+			t.Fatalf("failed to parse %q (from %q): %v", out, str, err)
+		}
+
+		if again.String() != out {
+			t.Fatalf("round trip changed %q to %q", out, again.String())
+		}
+
+		if !u.Equal(again) {
+			t.Fatalf("%q is not equal to its round trip %q", str, out)
+		}
+	})
+}
+
+func FuzzParseTelURI(f *testing.F) {
+	for _, seed := range []string{
+		"tel:+1-201-555-0123",
+		"tel:7042;phone-context=example.com",
+		"tel:863-1234;phone-context=+1-914-555;ext=1;isub=abc;foo=bar",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		tel, err := ParseTelURI(str)
+		if err != nil {
+			return
+		}
+
+		again, err := ParseTelURI(tel.String())
+		if err != nil {
+			t.Fatalf("failed to parse %q (from %q): %v", tel.String(), str, err)
+		}
+
+		if !tel.Equal(again) {
+			t.Fatalf("%q is not equal to its round trip %q", str, tel.String())
+		}
+	})
+}
+
+func FuzzParseVia(f *testing.F) {
+	for _, seed := range []string{
+		"SIP/2.0/UDP pc33.example.com;branch=z9hG4bK776asdhds",
+		"SIP / 2.0 / TCP [2001:db8::1]:5060 ; rport ; branch=z9hG4bK1",
+		"SIP/2.0/TLS 192.0.2.1:5061;received=192.0.2.2;x=\"a b\"",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		v, err := ParseVia(str)
+		if err != nil {
+			return
+		}
+
+		out := v.String()
+		again, err := ParseVia(out)
+		if err != nil {
+			t.Fatalf("failed to parse %q (from %q): %v", out, str, err)
+		}
+
+		if again.String() != out {
+			t.Fatalf("round trip changed %q to %q", out, again.String())
+		}
+	})
+}
+
+func FuzzParseUser(f *testing.F) {
+	for _, seed := range []string{
+		"Alice <sip:alice@example.com>;tag=1234",
+		"\"Alice \\\"A\\\" Smith\" <sip:alice@example.com>",
+		"sip:alice@example.com;tag=1234",
+		"<tel:+1-201-555-0123>",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		user, err := ParseUser(str)
+		if err != nil {
+			return
+		}
+
+		out := user.String()
+		again, err := ParseUser(out)
+		if err != nil {
+			t.Fatalf("failed to parse %q (from %q): %v", out, str, err)
+		}
+
+		if again.String() != out {
+			t.Fatalf("round trip changed %q to %q", out, again.String())
+		}
+	})
+}
+
+func FuzzParseUserList(f *testing.F) {
+	f.Add("<sip:p1.example.com;lr>, <sip:p2.example.com;lr>")
+	f.Add("\"a, b\" <sip:a@example.com>, sip:b@example.com")
+
+	f.Fuzz(func(t *testing.T, str string) {
+		users, err := ParseUserList(str)
+		if err != nil {
+			return
+		}
+
+		for _, user := range users {
+			if _, err := ParseUser(user.String()); err != nil {
+				t.Fatalf("failed to parse %q (from %q): %v", user.String(),
+					str, err)
+			}
+		}
+	})
+}
+
+func FuzzParsePairs(f *testing.F) {
+	for _, seed := range []string{
+		"realm=\"example.com\", nonce=\"abc\", qop=auth",
+		"k=",
+		"=v",
+		";;,,;;,;",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, str string) {
+		args := ParsePairs(str)
+		args.CommaString()
+		args.SemicolonString()
+		ParseHeaderArgs(str)
+		ParseList(str)
+	})
+}
+
+func FuzzHeaderValues(f *testing.F) {
+	f.Add("1 INVITE")
+	f.Add("70")
+	f.Add("multipart/mixed;boundary=\"a b\"")
+
+	f.Fuzz(func(t *testing.T, str string) {
+		if cseq, err := ParseCSeq(str); err == nil {
+			if again, err := ParseCSeq(cseq.String()); err != nil ||
+				again != cseq {
+				t.Fatalf("CSeq round trip of %q failed", str)
+			}
+		}
+
+		if mediaType, err := ParseContentType(str); err == nil {
+			out := mediaType.String()
+			if again, err := ParseContentType(out); err != nil ||
+				again.String() != out {
+				t.Fatalf("Content-Type round trip of %q failed", str)
+			}
+		}
+
+		ParseMaxForwards(str)
+		ParseExpires(str)
+
+		var h Header
+		h.Set("Contact", str)
+		h.Set("Route", str)
+		h.Set("Allow", str)
+		ParseContacts(&h)
+		ParseRoutes(&h, "Route")
+		ParseTokenList(&h, "Allow")
+	})
+}
+
+func FuzzParseMultipart(f *testing.F) {
+	f.Add([]byte("--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n--b--\r\n"))
+	f.Add([]byte("preamble\n--b \n\nhi\n--b\n\n\n--b--"))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		parts, err := ParseMultipart("multipart/mixed;boundary=b", body)
+		if err != nil {
+			return
+		}
+
+		for _, p := range parts {
+			p.ContentType()
+			p.Parts()
+		}
+
+		// The parts must survive being built into a new body.
+		m := &Multipart{Boundary: "b", Parts: parts}
+		again, err := ParseMultipart(m.ContentType().String(), m.Marshal())
+		if err != nil || len(again) != len(parts) {
+			t.Fatalf("failed to read back %q: %v", m.Marshal(), err)
+		}
+
+		for i := range parts {
+			if !bytes.Equal(again[i].Body, parts[i].Body) {
+				t.Fatalf("part %d changed from %q to %q", i, parts[i].Body,
+					again[i].Body)
+			}
+		}
+	})
+}
+
+func FuzzHeader(f *testing.F) {
+	f.Add("Via: SIP/2.0/UDP a, SIP/2.0/UDP b\r\n\r\n")
+	f.Add("m: \"a, b\" <sip:a@example.com>, <sip:b@example.com>\r\n\r\n")
+	f.Add("Subject: folded\r\n line\r\nl: 0\r\nX-A: a, b\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		h, err := parseTestHeader(data)
+		if err != nil {
+			return
+		}
+
+		for _, compact := range []bool{false, true} {
+			buf := new(bytes.Buffer)
+			h.write(buf, compact)
+			out := buf.String()
+
+			again, err := parseTestHeader(out)
+			if err != nil {
+				t.Fatalf("failed to parse %q (from %q): %v", out, data, err)
+			}
+
+			if !reflect.DeepEqual(again.Keys(), h.Keys()) {
+				t.Fatalf("keys changed from %q to %q", h.Keys(), again.Keys())
+			}
+
+			for _, key := range h.Keys() {
+				if !reflect.DeepEqual(again.Values(key), h.Values(key)) {
+					t.Fatalf("%s changed from %q to %q", key, h.Values(key),
+						again.Values(key))
+				}
+			}
+
+			buf.Reset()
+			again.write(buf, compact)
+			if buf.String() != out {
+				t.Fatalf("round trip changed %q to %q", out, buf.String())
+			}
+		}
+	})
+}
@@ -5,43 +5,330 @@ import (
 	"strings"
 )
 
-// Header represents the headers of a SIP Request or Response.
-type Header map[string]string
+// Header represents the headers of a SIP Request or Response. Each header
+// field holds an ordered list of values, as a field may appear on several
+// lines (or as a comma separated list) in a message. The zero value is an
+// empty header ready to use.
+//
+// The order of fields in parsed messages is preserved. Fields newly added
+// with Add or Set are placed according to a stable recommended order, with
+// Via first and Content-Length last, so built messages always serialize
+// the same way.
+//
+// Header values share their underlying storage when copied, use Clone to
+// obtain an independent copy.
+type Header struct {
+	fields []headerField
+}
+
+type headerField struct {
+	key    string
+	values []string
+}
+
+// listHeaders contains the header fields whose grammar allows several
+// comma separated values on a single line.
+var listHeaders = map[string]bool{
+	"Accept":           true,
+	"Accept-Encoding":  true,
+	"Accept-Language":  true,
+	"Alert-Info":       true,
+	"Allow":            true,
+	"Allow-Events":     true,
+	"Call-Info":        true,
+	"Contact":          true,
+	"Content-Encoding": true,
+	"Content-Language": true,
+	"Error-Info":       true,
+	"In-Reply-To":      true,
+	"Proxy-Require":    true,
+	"Reason":           true,
+	"Record-Route":     true,
+	"Require":          true,
+	"Route":            true,
+	"Supported":        true,
+	"Unsupported":      true,
+	"Via":              true,
+	"Warning":          true,
+}
+
+// headerOrder is the recommended order of header fields in a message.
+// Fields not in this list are placed at the position of the empty string.
+var headerOrder = []string{
+	"Via",
+	"Route",
+	"Record-Route",
+	"Path",
+	"Service-Route",
+	"Max-Forwards",
+	"From",
+	"To",
+	"Call-ID",
+	"CSeq",
+	"Contact",
+	"Expires",
+	"Min-Expires",
+	"Authorization",
+	"Proxy-Authorization",
+	"WWW-Authenticate",
+	"Proxy-Authenticate",
+	"Authentication-Info",
+	"Allow",
+	"Supported",
+	"Require",
+	"Proxy-Require",
+	"Unsupported",
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"User-Agent",
+	"Server",
+	"",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"Content-Length",
+}
+
+var headerRanks = make(map[string]int)
+
+func init() {
+	for i, key := range headerOrder {
+		headerRanks[key] = i
+	}
+}
+
+func headerRank(key string) int {
+	if rank, found := headerRanks[key]; found {
+		return rank
+	}
+
+	return headerRanks[""]
+}
+
+func (h *Header) field(key string) *headerField {
+	for i := range h.fields {
+		if h.fields[i].key == key {
+			return &h.fields[i]
+		}
+	}
+
+	return nil
+}
+
+// Add adds a value to the list of values of a header key. If the header
+// field allows comma separated values, value is split into its
+// individual elements.
+func (h *Header) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	values := splitHeaderValue(key, value)
+
+	if f := h.field(key); f != nil {
+		f.values = append(f.values, values...)
+		return
+	}
+
+	h.insert(headerField{key: key, values: values})
+}
+
+// Del deletes the key and all of its values from the header. Deleting a
+// non-existent key is a no-op.
+func (h *Header) Del(key string) {
+	key = CanonicalHeaderKey(key)
+	for i := range h.fields {
+		if h.fields[i].key == key {
+			h.fields = append(h.fields[:i:i], h.fields[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns the first value at a given key. It returns an empty string if
+// the key does not exist. Use Values to access all of the values.
+func (h *Header) Get(key string) string {
+	value, _ := h.First(key)
+	return value
+}
+
+// First returns the first value at a given key, and whether or not
+// the key exists.
+func (h *Header) First(key string) (string, bool) {
+	f := h.field(CanonicalHeaderKey(key))
+	if f == nil || len(f.values) == 0 {
+		return "", false
+	}
+
+	return f.values[0], true
+}
+
+// Values returns all of the values at a given key in order. It returns nil
+// if the key does not exist.
+func (h *Header) Values(key string) []string {
+	f := h.field(CanonicalHeaderKey(key))
+	if f == nil {
+		return nil
+	}
 
-// Del deletes the key and its value from the header. Deleting a non-existent
-// key is a no-op.
-func (h Header) Del(key string) {
-	delete(h, normalizeKey(key))
+	return append([]string(nil), f.values...)
 }
 
-// Get returns the value at a given key. It returns an empty string if the
-// key does not exist.
-func (h Header) Get(key string) string {
-	return h[normalizeKey(key)]
+// Set sets a header key with a value, replacing any existing values. If the
+// header field allows comma separated values, value is split into its
+// individual elements.
+func (h *Header) Set(key, value string) {
+	key = CanonicalHeaderKey(key)
+	values := splitHeaderValue(key, value)
+
+	if f := h.field(key); f != nil {
+		f.values = values
+		return
+	}
+
+	h.insert(headerField{key: key, values: values})
 }
 
-// Set sets a header key with a value.
-func (h Header) Set(key, value string) {
-	h[normalizeKey(key)] = value
+// insert inserts a new field before the first field which comes after it
+// in the recommended order.
+func (h *Header) insert(f headerField) {
+	rank := headerRank(f.key)
+	for i := range h.fields {
+		if headerRank(h.fields[i].key) > rank {
+			h.fields = append(h.fields, headerField{})
+			copy(h.fields[i+1:], h.fields[i:])
+			h.fields[i] = f
+			return
+		}
+	}
+
+	h.fields = append(h.fields, f)
+}
+
+// appendRaw adds a value to the list of values of a header key, adding
+// new fields to the end of the header. It is used when parsing to preserve
+// the order of fields in a message.
+func (h *Header) appendRaw(key, value string) {
+	key = CanonicalHeaderKey(key)
+	values := splitHeaderValue(key, value)
+
+	if f := h.field(key); f != nil {
+		f.values = append(f.values, values...)
+		return
+	}
+
+	h.fields = append(h.fields, headerField{key: key, values: values})
+}
+
+// Keys returns the keys present in the header in order.
+func (h *Header) Keys() []string {
+	keys := make([]string, len(h.fields))
+	for i, f := range h.fields {
+		keys[i] = f.key
+	}
+
+	return keys
+}
+
+// Clone returns a copy of the header which does not share any storage
+// with the original.
+func (h *Header) Clone() Header {
+	fields := make([]headerField, len(h.fields))
+	for i, f := range h.fields {
+		fields[i] = headerField{
+			key:    f.key,
+			values: append([]string(nil), f.values...),
+		}
+	}
+
+	return Header{fields: fields}
 }
 
 // WriteTo writes the header data to a writer, with an additional CRLF
-// (i.e. "\r\n") at the end.
-func (h Header) WriteTo(w io.Writer) (int64, error) {
+// (i.e. "\r\n") at the end. Each value is written on its own line.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	return h.write(w, false)
+}
+
+// WriteCompactTo is like WriteTo, but writes header field names using
+// their compact forms where one exists, which is useful to reduce the size
+// of messages sent over UDP.
+func (h *Header) WriteCompactTo(w io.Writer) (int64, error) {
+	return h.write(w, true)
+}
+
+func (h *Header) write(w io.Writer, compact bool) (int64, error) {
 	var total int64
-	for key, value := range h {
-		n, err := w.Write([]byte(key + ": " + value + "\r\n"))
-		total += int64(n)
-		if err != nil {
-			return total, err
+	for _, f := range h.fields {
+		key := f.key
+		if compact {
+			key = CompactHeaderKey(key)
+		}
+
+		for _, value := range f.values {
+			n, err := io.WriteString(w, key+": "+value+"\r\n")
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
 		}
 	}
 
-	n, err := w.Write([]byte("\r\n"))
+	n, err := io.WriteString(w, "\r\n")
 	total += int64(n)
 	return total, err
 }
 
-func normalizeKey(key string) string {
-	return strings.Title(strings.ToLower(key))
+// splitHeaderValue splits a comma separated header value into its elements
+// if the header field's grammar allows it.
+func splitHeaderValue(key, value string) []string {
+	value = strings.TrimSpace(value)
+	if !listHeaders[key] {
+		return []string{value}
+	}
+
+	values := splitList(value)
+	if len(values) == 0 {
+		return []string{""}
+	}
+
+	return values
+}
+
+// splitList splits a comma separated list into its trimmed, non-empty
+// elements. Commas within quoted strings and angle brackets are not treated
+// as separators.
+func splitList(value string) []string {
+	var values []string
+	var quote, escape bool
+	var angle int
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case escape:
+			escape = false
+		case quote:
+			if c == '\\' {
+				escape = true
+			} else if c == '"' {
+				quote = false
+			}
+		case c == '"':
+			quote = true
+		case c == '<':
+			angle++
+		case c == '>' && angle > 0:
+			angle--
+		case c == ',' && angle == 0:
+			if elem := strings.TrimSpace(value[start:i]); elem != "" {
+				values = append(values, elem)
+			}
+			start = i + 1
+		}
+	}
+
+	if elem := strings.TrimSpace(value[start:]); elem != "" {
+		values = append(values, elem)
+	}
+
+	return values
 }
@@ -2,14 +2,27 @@ package sipnet
 
 import (
 	"bytes"
-	"strconv"
 	"strings"
 )
 
+// HeaderArg represents a single argument of a HeaderArgs list.
+type HeaderArg struct {
+	Key   string
+	Value string
+
+	// Quoted is true if the value is written as a quoted-string. Values
+	// which cannot be written as a token are always quoted.
+	Quoted bool
+}
+
 // HeaderArgs represents the arguments which can be found in headers,
 // and in other simple key value fields whose format is of a
-// key=value with a delimiter.
-type HeaderArgs map[string]string
+// key=value with a delimiter. Arguments are kept in their original order,
+// may be duplicated, and their keys are compared case-insensitively.
+//
+// HeaderArgs methods never modify a list in place, so copies of a
+// HeaderArgs can be modified independently.
+type HeaderArgs []HeaderArg
 
 // ParseList parses a comma, semicolon, or new line separated list of values
 // and returns list elements.
@@ -57,58 +70,145 @@ func ParseList(value string) []string {
 //
 // Lifted from https://code.google.com/p/gorilla/source/browse/http/parser/parser.go
 func ParsePairs(value string) HeaderArgs {
-	m := make(HeaderArgs)
+	var args HeaderArgs
 	for _, pair := range ParseList(strings.TrimSpace(value)) {
-		if i := strings.Index(pair, "="); i < 0 {
-			m[pair] = ""
-		} else {
-			v := pair[i+1:]
-			if v[0] == '"' && v[len(v)-1] == '"' {
-				v = v[1 : len(v)-1]
-			}
-			m[pair[:i]] = v
+		if pair == "" {
+			continue
+		}
+
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			args = append(args, HeaderArg{Key: pair})
+			continue
 		}
+
+		arg := HeaderArg{
+			Key:   strings.TrimSpace(pair[:i]),
+			Value: strings.TrimSpace(pair[i+1:]),
+		}
+		if v := arg.Value; len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			arg.Value = v[1 : len(v)-1]
+			arg.Quoted = true
+		}
+
+		args = append(args, arg)
 	}
-	return m
+	return args
 }
 
 // ParseHeaderArgs parses header arguments from a full header.
 func ParseHeaderArgs(str string) HeaderArgs {
 	argLocation := strings.Index(str, ";")
 	if argLocation < 0 {
-		return make(HeaderArgs)
+		return nil
 	}
 
 	return ParsePairs(str[argLocation+1:])
 }
 
-// Del deletes the key and its value from the header arguments. Deleting a non-existent
+// Del deletes all of the arguments with a key. Deleting a non-existent
 // key is a no-op.
-func (h HeaderArgs) Del(key string) {
-	delete(h, key)
+func (h *HeaderArgs) Del(key string) {
+	var result HeaderArgs
+	for _, arg := range *h {
+		if !strings.EqualFold(arg.Key, key) {
+			result = append(result, arg)
+		}
+	}
+	*h = result
 }
 
-// Get returns the value at a given key. It returns an empty string if the
-// key does not exist.
+// Get returns the value of the first argument with a given key. It returns
+// an empty string if the key does not exist.
 func (h HeaderArgs) Get(key string) string {
-	return h[key]
+	value, _ := h.Lookup(key)
+	return value
+}
+
+// Lookup returns the value of the first argument with a given key, and
+// whether or not the key exists.
+func (h HeaderArgs) Lookup(key string) (string, bool) {
+	for _, arg := range h {
+		if strings.EqualFold(arg.Key, key) {
+			return arg.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Has returns whether or not an argument with a given key exists, which is
+// useful for arguments without values, such as "lr".
+func (h HeaderArgs) Has(key string) bool {
+	_, found := h.Lookup(key)
+	return found
+}
+
+// Values returns the values of all the arguments with a given key in order.
+func (h HeaderArgs) Values(key string) []string {
+	var values []string
+	for _, arg := range h {
+		if strings.EqualFold(arg.Key, key) {
+			values = append(values, arg.Value)
+		}
+	}
+	return values
+}
+
+// Set sets a header argument key with a value, replacing all existing
+// arguments with the key. The argument keeps its position and quoting if it
+// already exists, otherwise it is added to the end.
+func (h *HeaderArgs) Set(key, value string) {
+	h.set(HeaderArg{Key: key, Value: value}, false)
 }
 
-// Set sets a header argument key with a value.
-func (h HeaderArgs) Set(key, value string) {
-	h[key] = value
+// SetQuoted is like Set, but always writes the value as a quoted-string.
+// It should be used for arguments whose grammar requires a quoted-string,
+// such as the realm and nonce of a digest challenge.
+func (h *HeaderArgs) SetQuoted(key, value string) {
+	h.set(HeaderArg{Key: key, Value: value, Quoted: true}, true)
+}
+
+func (h *HeaderArgs) set(newArg HeaderArg, forceQuoting bool) {
+	var result HeaderArgs
+	found := false
+	for _, arg := range *h {
+		if !strings.EqualFold(arg.Key, newArg.Key) {
+			result = append(result, arg)
+			continue
+		}
+
+		if found {
+			continue
+		}
+
+		found = true
+		if !forceQuoting {
+			newArg.Quoted = arg.Quoted
+		}
+		newArg.Key = arg.Key
+		result = append(result, newArg)
+	}
+
+	if !found {
+		result = append(result, newArg)
+	}
+
+	*h = result
+}
+
+// Add adds an argument to the end of the arguments, keeping any existing
+// arguments with the same key.
+func (h *HeaderArgs) Add(key, value string) {
+	*h = append((*h)[:len(*h):len(*h)], HeaderArg{Key: key, Value: value})
 }
 
 // SemicolonString returns the header arguments as a semicolon
-// separated unquoted strings with a leading semicolon.
+// separated string with a leading semicolon.
 func (h HeaderArgs) SemicolonString() string {
 	var result string
-	for key, value := range h {
-		if value == "" {
-			result += ";" + key
-		} else {
-			result += ";" + key + "=" + value
-		}
+	for _, arg := range h {
+		result += ";" + arg.String()
 	}
 	return result
 }
@@ -116,26 +216,171 @@ func (h HeaderArgs) SemicolonString() string {
 // CommaString returns the header arguments as a comma and space
 // separated string.
 func (h HeaderArgs) CommaString() string {
-	if len(h) == 0 {
-		return ""
+	result := make([]string, len(h))
+	for i, arg := range h {
+		result[i] = arg.String()
 	}
+	return strings.Join(result, ", ")
+}
 
+// CRLFString returns the header arguments as a CRLF separated string.
+func (h HeaderArgs) CRLFString() string {
 	var result string
-	for key, value := range h {
-		result += key + "=" + strconv.Quote(value) + ", "
+	for _, arg := range h {
+		result += arg.Key + "=" + arg.Value + "\r\n"
 	}
-	return result[:len(result)-2]
+	return result
 }
 
-// CRLFString returns the header arguments as a CRLF separated string.
-func (h HeaderArgs) CRLFString() string {
-	if len(h) == 0 {
-		return ""
+// String returns the text representation of the argument, quoting the value
+// if needed.
+func (a HeaderArg) String() string {
+	if a.Value == "" && !a.Quoted {
+		return a.Key
 	}
 
-	var result string
-	for key, value := range h {
-		result += key + "=" + value + "\r\n"
+	if a.Quoted || !isArgValue(a.Value) {
+		return a.Key + "=" + quoteString(a.Value)
+	}
+
+	return a.Key + "=" + a.Value
+}
+
+// isTokenChar reports whether c is allowed in a token as defined by
+// RFC 3261 section 25.1.
+func isTokenChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+
+	return strings.IndexByte("-.!%*_+`'~", c) >= 0
+}
+
+// isToken reports whether str is a non-empty token.
+func isToken(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for i := 0; i < len(str); i++ {
+		if !isTokenChar(str[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isArgValue reports whether str can be written as an unquoted argument
+// value, which is either a token or a host (which includes IPv6 references).
+func isArgValue(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for i := 0; i < len(str); i++ {
+		if !isTokenChar(str[i]) && strings.IndexByte(":[]", str[i]) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// quoteString returns str as a quoted-string, escaping quotes and
+// backslashes.
+func quoteString(str string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(str); i++ {
+		if str[i] == '"' || str[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(str[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// readQuotedString reads a quoted-string at the start of str, and returns
+// its unescaped contents and the number of bytes read.
+func readQuotedString(str string) (string, int, error) {
+	if !strings.HasPrefix(str, "\"") {
+		return "", 0, ErrParseError
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			i++
+			if i >= len(str) {
+				return "", 0, ErrParseError
+			}
+			b.WriteByte(str[i])
+		case '"':
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(str[i])
+		}
+	}
+
+	return "", 0, ErrParseError
+}
+
+// parseSemicolonArgs strictly parses semicolon separated arguments with a
+// leading semicolon (i.e. ";tag=1234;lr"), as found after the URI of a user
+// line or the sent-by of a Via. Values may be tokens, hosts or quoted
+// strings.
+func parseSemicolonArgs(str string) (HeaderArgs, error) {
+	var args HeaderArgs
+	for {
+		str = strings.TrimLeft(str, " \t")
+		if str == "" {
+			return args, nil
+		}
+
+		if str[0] != ';' {
+			return nil, ErrParseError
+		}
+
+		str = strings.TrimLeft(str[1:], " \t")
+		end := strings.IndexAny(str, "=; \t")
+		if end < 0 {
+			end = len(str)
+		}
+
+		arg := HeaderArg{Key: str[:end]}
+		if !isToken(arg.Key) {
+			return nil, ErrParseError
+		}
+
+		str = strings.TrimLeft(str[end:], " \t")
+		if strings.HasPrefix(str, "=") {
+			str = strings.TrimLeft(str[1:], " \t")
+			if strings.HasPrefix(str, "\"") {
+				value, n, err := readQuotedString(str)
+				if err != nil {
+					return nil, err
+				}
+
+				arg.Value = value
+				arg.Quoted = true
+				str = str[n:]
+			} else {
+				end = strings.IndexAny(str, "; \t")
+				if end < 0 {
+					end = len(str)
+				}
+
+				arg.Value = str[:end]
+				if !isArgValue(arg.Value) {
+					return nil, ErrParseError
+				}
+				str = str[end:]
+			}
+		}
+
+		args = append(args, arg)
 	}
-	return result
 }
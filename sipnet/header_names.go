@@ -0,0 +1,90 @@
+package sipnet
+
+import "strings"
+
+// headerNames contains the standard spelling of well known header field
+// names, keyed by their lower case form.
+var headerNames = make(map[string]string)
+
+// compactForms maps compact header field names (RFC 3261 section 7.3.3 and
+// later extensions) to their full names, and back.
+var compactForms = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+	"y": "Identity",
+}
+
+var fullForms = make(map[string]string)
+
+func init() {
+	for _, name := range []string{
+		"Accept", "Accept-Contact", "Accept-Encoding", "Accept-Language",
+		"Accept-Resource-Priority", "Alert-Info", "Allow", "Allow-Events",
+		"Authentication-Info", "Authorization", "Call-ID", "Call-Info",
+		"Contact", "Content-Disposition", "Content-Encoding", "Content-ID",
+		"Content-Language", "Content-Length", "Content-Type", "CSeq", "Date",
+		"Error-Info", "Event", "Expires", "From", "History-Info", "Identity",
+		"In-Reply-To", "Max-Forwards", "MIME-Version", "Min-Expires",
+		"Min-SE", "Organization", "P-Asserted-Identity",
+		"P-Preferred-Identity", "Path", "Priority", "Privacy",
+		"Proxy-Authenticate", "Proxy-Authorization", "Proxy-Require", "RAck",
+		"Reason", "Record-Route", "Refer-To", "Referred-By", "Reject-Contact",
+		"Replaces", "Reply-To", "Request-Disposition", "Require",
+		"Resource-Priority", "Retry-After", "Route", "RSeq",
+		"Security-Client", "Security-Server", "Security-Verify", "Server",
+		"Service-Route", "Session-Expires", "SIP-ETag", "SIP-If-Match",
+		"Subject", "Subscription-State", "Supported", "Timestamp", "To",
+		"Unsupported", "User-Agent", "Via", "Warning", "WWW-Authenticate",
+	} {
+		headerNames[strings.ToLower(name)] = name
+	}
+
+	for compact, name := range compactForms {
+		fullForms[name] = compact
+	}
+}
+
+// CanonicalHeaderKey returns the canonical format of a header field name.
+// Compact forms are expanded to their full names, well known names use
+// their standard spelling (i.e. "Call-ID", "CSeq" and "WWW-Authenticate"),
+// and any other name has the first letter of each hyphen separated word
+// upper cased.
+func CanonicalHeaderKey(key string) string {
+	lower := strings.ToLower(strings.TrimSpace(key))
+	if name, found := compactForms[lower]; found {
+		return name
+	}
+
+	if name, found := headerNames[lower]; found {
+		return name
+	}
+
+	return strings.Title(lower)
+}
+
+// CompactHeaderKey returns the compact form of a header field name, or the
+// canonical name if the field has no compact form.
+func CompactHeaderKey(key string) string {
+	key = CanonicalHeaderKey(key)
+	if compact, found := fullForms[key]; found {
+		return compact
+	}
+
+	return key
+}
@@ -0,0 +1,174 @@
+package sipnet
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// parseTestHeader parses a header block, which ends with an empty line.
+func parseTestHeader(data string) (Header, error) {
+	var h Header
+	rd := &lineReader{Reader: bufio.NewReader(strings.NewReader(data))}
+	err := DefaultParserConfig.parseHeader(rd, &h)
+	return h, err
+}
+
+func TestHeaderWrite(t *testing.T) {
+	built := func() Header {
+		var h Header
+		h.Set("Content-Length", "0")
+		h.Set("X-Custom", "a, b")
+		h.Set("Call-ID", "a84b4c76e66710")
+		h.Set("CSeq", "1 INVITE")
+		h.Set("From", "<sip:alice@example.com>;tag=1928301774")
+		h.Set("Via", "SIP/2.0/UDP a.example.com;branch=z9hG4bK1, "+
+			"SIP/2.0/UDP b.example.com")
+		h.Set("Content-Type", "application/sdp")
+		h.Set("Max-Forwards", "70")
+		h.Set("To", "<sip:bob@example.com>")
+		h.Add("contact", "\"a, b\" <sip:a@example.com>, <sip:b@example.com>")
+		h.Set("Supported", "timer")
+		return h
+	}
+
+	parsed := func() Header {
+		h, err := parseTestHeader("t: <sip:bob@example.com>\r\n" +
+			"f: <sip:alice@example.com>;tag=1928301774\r\n" +
+			"Subject: a,\r\n b\r\n" +
+			"v: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+			"VIA: SIP/2.0/UDP b.example.com , SIP/2.0/UDP c.example.com\r\n" +
+			"call-id:a84b4c76e66710\r\n" +
+			"l: 0\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for _, c := range []struct {
+		name    string
+		header  func() Header
+		long    string
+		compact string
+	}{
+		{
+			name:   "built",
+			header: built,
+			long: "Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"Via: SIP/2.0/UDP b.example.com\r\n" +
+				"Max-Forwards: 70\r\n" +
+				"From: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"To: <sip:bob@example.com>\r\n" +
+				"Call-ID: a84b4c76e66710\r\n" +
+				"CSeq: 1 INVITE\r\n" +
+				"Contact: \"a, b\" <sip:a@example.com>\r\n" +
+				"Contact: <sip:b@example.com>\r\n" +
+				"Supported: timer\r\n" +
+				"X-Custom: a, b\r\n" +
+				"Content-Type: application/sdp\r\n" +
+				"Content-Length: 0\r\n\r\n",
+			compact: "v: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"v: SIP/2.0/UDP b.example.com\r\n" +
+				"Max-Forwards: 70\r\n" +
+				"f: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"t: <sip:bob@example.com>\r\n" +
+				"i: a84b4c76e66710\r\n" +
+				"CSeq: 1 INVITE\r\n" +
+				"m: \"a, b\" <sip:a@example.com>\r\n" +
+				"m: <sip:b@example.com>\r\n" +
+				"k: timer\r\n" +
+				"X-Custom: a, b\r\n" +
+				"c: application/sdp\r\n" +
+				"l: 0\r\n\r\n",
+		},
+		{
+			// Parsed fields keep their order, with the values of a field
+			// gathered where it first appears.
+			name:   "parsed",
+			header: parsed,
+			long: "To: <sip:bob@example.com>\r\n" +
+				"From: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"Subject: a, b\r\n" +
+				"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"Via: SIP/2.0/UDP b.example.com\r\n" +
+				"Via: SIP/2.0/UDP c.example.com\r\n" +
+				"Call-ID: a84b4c76e66710\r\n" +
+				"Content-Length: 0\r\n\r\n",
+			compact: "t: <sip:bob@example.com>\r\n" +
+				"f: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"s: a, b\r\n" +
+				"v: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"v: SIP/2.0/UDP b.example.com\r\n" +
+				"v: SIP/2.0/UDP c.example.com\r\n" +
+				"i: a84b4c76e66710\r\n" +
+				"l: 0\r\n\r\n",
+		},
+		{
+			// New fields of a parsed header are placed before the first
+			// field which comes after them in the recommended order.
+			name: "parsed then built",
+			header: func() Header {
+				h := parsed()
+				h.Set("Max-Forwards", "70")
+				h.Add("Via", "SIP/2.0/UDP d.example.com")
+				h.Set("CSeq", "2 BYE")
+				return h
+			},
+			long: "Max-Forwards: 70\r\n" +
+				"To: <sip:bob@example.com>\r\n" +
+				"From: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"CSeq: 2 BYE\r\n" +
+				"Subject: a, b\r\n" +
+				"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"Via: SIP/2.0/UDP b.example.com\r\n" +
+				"Via: SIP/2.0/UDP c.example.com\r\n" +
+				"Via: SIP/2.0/UDP d.example.com\r\n" +
+				"Call-ID: a84b4c76e66710\r\n" +
+				"Content-Length: 0\r\n\r\n",
+			compact: "Max-Forwards: 70\r\n" +
+				"t: <sip:bob@example.com>\r\n" +
+				"f: <sip:alice@example.com>;tag=1928301774\r\n" +
+				"CSeq: 2 BYE\r\n" +
+				"s: a, b\r\n" +
+				"v: SIP/2.0/UDP a.example.com;branch=z9hG4bK1\r\n" +
+				"v: SIP/2.0/UDP b.example.com\r\n" +
+				"v: SIP/2.0/UDP c.example.com\r\n" +
+				"v: SIP/2.0/UDP d.example.com\r\n" +
+				"i: a84b4c76e66710\r\n" +
+				"l: 0\r\n\r\n",
+		},
+		{
+			name:    "empty",
+			header:  func() Header { return Header{} },
+			long:    "\r\n",
+			compact: "\r\n",
+		},
+	} {
+		h := c.header()
+		for _, form := range []struct {
+			write func(*Header, *bytes.Buffer) (int64, error)
+			want  string
+		}{
+			{func(h *Header, buf *bytes.Buffer) (int64, error) {
+				return h.WriteTo(buf)
+			}, c.long},
+			{func(h *Header, buf *bytes.Buffer) (int64, error) {
+				return h.WriteCompactTo(buf)
+			}, c.compact},
+		} {
+			buf := new(bytes.Buffer)
+			n, err := form.write(&h, buf)
+			if err != nil || n != int64(buf.Len()) {
+				t.Errorf("%s: wrote %d of %d bytes, %v", c.name, n, buf.Len(),
+					err)
+			}
+
+			if buf.String() != form.want {
+				t.Errorf("%s: got\n%q\nwant\n%q", c.name, buf.String(),
+					form.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package sipnet
+
+import (
+	"strconv"
+	"strings"
+)
+
+// HeaderError is returned when the value of a header fails to be parsed.
+// It matches ErrParseError with errors.Is.
+type HeaderError struct {
+	Header string
+	Value  string
+	Cause  string
+}
+
+func (e *HeaderError) Error() string {
+	return "sip: malformed " + e.Header + " header: " + e.Cause
+}
+
+// Unwrap returns ErrParseError.
+func (e *HeaderError) Unwrap() error {
+	return ErrParseError
+}
+
+// Reason returns a short description of the error suitable for the reason
+// phrase of a 400 Bad Request response.
+func (e *HeaderError) Reason() string {
+	return "Malformed " + e.Header + " header"
+}
+
+func headerError(header, value, cause string) *HeaderError {
+	return &HeaderError{Header: header, Value: value, Cause: cause}
+}
+
+// CSeq represents the contents of a CSeq header.
+type CSeq struct {
+	Seq    uint32
+	Method string
+}
+
+// ParseCSeq parses the value of a CSeq header.
+func ParseCSeq(str string) (CSeq, error) {
+	fields := strings.Fields(str)
+	if len(fields) != 2 {
+		return CSeq{}, headerError("CSeq", str,
+			"expected a sequence number and method")
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return CSeq{}, headerError("CSeq", str, "invalid sequence number")
+	}
+
+	if !isToken(fields[1]) {
+		return CSeq{}, headerError("CSeq", str, "invalid method")
+	}
+
+	return CSeq{Seq: uint32(seq), Method: fields[1]}, nil
+}
+
+// String returns the text representation of the CSeq.
+func (c CSeq) String() string {
+	return strconv.FormatUint(uint64(c.Seq), 10) + " " + c.Method
+}
+
+// ParseMaxForwards parses the value of a Max-Forwards header, which is
+// between 0 and 255.
+func ParseMaxForwards(str string) (int, error) {
+	value, err := parseDeltaSeconds(str)
+	if err != nil || value > 255 {
+		return 0, headerError("Max-Forwards", str,
+			"expected a number between 0 and 255")
+	}
+
+	return int(value), nil
+}
+
+// ParseExpires parses the value of an Expires header, or the expires
+// parameter of a Contact, as a number of seconds.
+func ParseExpires(str string) (uint32, error) {
+	value, err := parseDeltaSeconds(str)
+	if err != nil {
+		return 0, headerError("Expires", str, "expected a number of seconds")
+	}
+
+	return value, nil
+}
+
+func parseDeltaSeconds(str string) (uint32, error) {
+	str = strings.TrimSpace(str)
+	if str == "" || str[0] == '+' || str[0] == '-' {
+		return 0, ErrParseError
+	}
+
+	value, err := strconv.ParseUint(str, 10, 32)
+	if err != nil {
+		return 0, ErrParseError
+	}
+
+	return uint32(value), nil
+}
+
+// Contact represents a single value of a Contact header.
+type Contact struct {
+	User
+
+	// Wildcard is true for the "*" contact, which is used to remove all of
+	// the registrations of an address-of-record.
+	Wildcard bool
+}
+
+// ParseContacts parses all of the values of the Contact headers of a header.
+// A wildcard contact must be the only contact.
+func ParseContacts(h *Header) ([]Contact, error) {
+	values := h.Values("Contact")
+	var contacts []Contact
+	for _, value := range values {
+		if value == "*" {
+			if len(values) != 1 {
+				return nil, headerError("Contact", value,
+					"wildcard must be the only contact")
+			}
+
+			return []Contact{{Wildcard: true}}, nil
+		}
+
+		user, err := ParseUser(value)
+		if err != nil {
+			return nil, headerError("Contact", value, "invalid address")
+		}
+
+		contacts = append(contacts, Contact{User: user})
+	}
+
+	return contacts, nil
+}
+
+// Expires returns the value of the expires parameter of the contact, and
+// whether or not the contact has the parameter.
+func (c Contact) Expires() (uint32, bool, error) {
+	value, found := c.Arguments.Lookup("expires")
+	if !found {
+		return 0, false, nil
+	}
+
+	expires, err := parseDeltaSeconds(value)
+	if err != nil {
+		return 0, true, headerError("Contact", c.String(),
+			"invalid expires parameter")
+	}
+
+	return expires, true, nil
+}
+
+// Q returns the value of the q parameter of the contact, which is the
+// contact's relative preference between 0 and 1. It returns 1 if the
+// contact has no q parameter.
+func (c Contact) Q() (float64, error) {
+	value, found := c.Arguments.Lookup("q")
+	if !found {
+		return 1, nil
+	}
+
+	q, err := parseQValue(value)
+	if err != nil {
+		return 0, headerError("Contact", c.String(), "invalid q parameter")
+	}
+
+	return q, nil
+}
+
+// parseQValue parses a qvalue, which RFC 3261 defines as
+// "0" [ "." 0*3DIGIT ] or "1" [ "." 0*3("0") ].
+func parseQValue(str string) (float64, error) {
+	if str == "" || len(str) > 5 || (str[0] != '0' && str[0] != '1') {
+		return 0, ErrParseError
+	}
+
+	fraction := str[1:]
+	if fraction == "" {
+		return float64(str[0] - '0'), nil
+	}
+
+	if fraction[0] != '.' {
+		return 0, ErrParseError
+	}
+
+	var thousandths int
+	for i := 1; i < 4; i++ {
+		thousandths *= 10
+		if i >= len(fraction) {
+			continue
+		}
+
+		if !isDigit(fraction[i]) || (str[0] == '1' && fraction[i] != '0') {
+			return 0, ErrParseError
+		}
+
+		thousandths += int(fraction[i] - '0')
+	}
+
+	return float64(str[0]-'0') + float64(thousandths)/1000, nil
+}
+
+// String returns the text representation of the contact.
+func (c Contact) String() string {
+	if c.Wildcard {
+		return "*"
+	}
+
+	return c.User.String()
+}
+
+// ParseTokenList parses all of the values of a header whose values are
+// a comma separated list of tokens, such as Allow, Supported, Require,
+// Proxy-Require and Unsupported.
+func ParseTokenList(h *Header, key string) ([]string, error) {
+	var tokens []string
+	for _, value := range h.Values(key) {
+		if value == "" {
+			continue
+		}
+
+		if !isToken(value) {
+			return nil, headerError(CanonicalHeaderKey(key), value,
+				"invalid token")
+		}
+
+		tokens = append(tokens, value)
+	}
+
+	return tokens, nil
+}
+
+// FormatTokenList returns the text representation of a list of tokens to
+// be used as the value of headers such as Allow and Supported.
+func FormatTokenList(tokens []string) string {
+	return strings.Join(tokens, ", ")
+}
+
+// ParseRoutes parses all of the values of a Route, Record-Route or other
+// header which holds a list of name-addrs.
+func ParseRoutes(h *Header, key string) ([]User, error) {
+	var routes []User
+	for _, value := range h.Values(key) {
+		user, err := ParseUser(value)
+		if err != nil {
+			return nil, headerError(CanonicalHeaderKey(key), value,
+				"invalid address")
+		}
+
+		routes = append(routes, user)
+	}
+
+	return routes, nil
+}
+
+// MediaType represents the contents of a Content-Type header, such as
+// "application/sdp" or "multipart/mixed;boundary=abc".
+type MediaType struct {
+	Type    string
+	Subtype string
+	Params  HeaderArgs
+}
+
+// ParseContentType parses the value of a Content-Type header. The type and
+// subtype are lower cased.
+func ParseContentType(str string) (MediaType, error) {
+	str = strings.TrimSpace(str)
+	typ, rest := readToken(str)
+	subtype, rest, ok := readSlashToken(rest)
+	if typ == "" || !ok {
+		return MediaType{}, headerError("Content-Type", str,
+			"expected a type and subtype")
+	}
+
+	params, err := parseSemicolonArgs(rest)
+	if err != nil {
+		return MediaType{}, headerError("Content-Type", str,
+			"invalid parameters")
+	}
+
+	return MediaType{
+		Type:    strings.ToLower(typ),
+		Subtype: strings.ToLower(subtype),
+		Params:  params,
+	}, nil
+}
+
+// String returns the text representation of the media type.
+func (m MediaType) String() string {
+	return m.Type + "/" + m.Subtype + m.Params.SemicolonString()
+}
+
+// accepts reports whether a media type, such as "application/sdp", is
+// within the media range of an Accept header, which may use "*" as the
+// type or subtype.
+func (m MediaType) accepts(mediaType string) bool {
+	slash := strings.IndexByte(mediaType, '/')
+	if slash < 0 {
+		return false
+	}
+
+	return (m.Type == "*" || strings.EqualFold(m.Type, mediaType[:slash])) &&
+		(m.Subtype == "*" || strings.EqualFold(m.Subtype, mediaType[slash+1:]))
+}
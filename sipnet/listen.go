@@ -1,6 +1,7 @@
 package sipnet
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
@@ -11,26 +12,86 @@ import (
 // the connection itself will also be returned.
 var ErrClosed = errors.New("sip: closed")
 
+// MalformedMessageError is reported when a message received by a Listener
+// fails to be parsed. It wraps the parse error (usually a *ParseError or
+// *LimitError) together with the address the message was received from.
+type MalformedMessageError struct {
+	Addr      net.Addr
+	Transport string
+
+	// Data is the received datagram. It is only set for UDP, as the
+	// malformed part of a stream is discarded as it is read.
+	Data []byte
+	Err  error
+}
+
+func (e *MalformedMessageError) Error() string {
+	return "sip: malformed message from " + e.Transport + " " +
+		e.Addr.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the parse error.
+func (e *MalformedMessageError) Unwrap() error {
+	return e.Err
+}
+
 type requestPackage struct {
 	conn *Conn
 	req  *Request
 	err  error
 }
 
+// ListenConfig holds the settings of a Listener. They are passed to the
+// listener when it is created, as its connections start reading them
+// straight away.
+type ListenConfig struct {
+	// ParserConfig is used to read messages received by the listener. If
+	// nil, DefaultParserConfig is used.
+	ParserConfig *ParserConfig
+
+	// MalformedMessage is called for every message received by the listener
+	// which fails to be parsed. It is called from the reader of the
+	// connection, so it should not block. If nil, the error is returned by
+	// AcceptRequest or Conn.Read instead.
+	MalformedMessage func(err *MalformedMessageError)
+
+	// Validator checks requests before they are returned by AcceptRequest,
+	// and responds to invalid requests. If nil, DefaultValidator is used.
+	Validator *Validator
+
+	// Timers are the timer values used by the transactions of the
+	// listener. If nil, DefaultTimers is used.
+	Timers *Timers
+}
+
 // Listener represents a TCP and UDP wrapper listener.
 type Listener struct {
+	config ListenConfig
+
 	tcpListener net.Listener
 	udpListener *net.UDPConn
-	closed      bool
+	closeOnce   sync.Once
+	done        chan struct{}
 
 	requestChannel chan requestPackage
+	transactions   *transactionTable
 
 	udpPool      map[string]*Conn
 	udpPoolMutex *sync.Mutex
+
+	tcpConns      map[*Conn]struct{}
+	tcpConnsMutex sync.Mutex
 }
 
-// Listen listens on an address (IP:port) on both TCP and UDP.
+// Listen listens on an address (IP:port) on both TCP and UDP, with the
+// default settings.
 func Listen(addr string) (*Listener, error) {
+	return (&ListenConfig{}).Listen(addr)
+}
+
+// Listen listens on an address (IP:port) on both TCP and UDP, with the
+// settings of lc. Changing lc afterwards does not affect the listener.
+func (lc *ListenConfig) Listen(addr string) (*Listener, error) {
 	tcpListener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
@@ -49,12 +110,15 @@ func Listen(addr string) (*Listener, error) {
 	}
 
 	listener := &Listener{
+		config:         *lc,
 		tcpListener:    tcpListener,
 		udpListener:    udpListener,
-		closed:         false,
+		done:           make(chan struct{}),
 		requestChannel: make(chan requestPackage),
+		transactions:   newTransactionTable(),
 		udpPool:        make(map[string]*Conn),
 		udpPoolMutex:   new(sync.Mutex),
+		tcpConns:       make(map[*Conn]struct{}),
 	}
 
 	go listener.udpJanitor()
@@ -70,14 +134,17 @@ func handleTCPListening(listener *Listener) {
 	for {
 		conn, err := listener.tcpListener.Accept()
 		if err != nil {
-			if listener.closed {
+			if listener.isClosed() {
 				return
 			}
 
-			listener.requestChannel <- requestPackage{
+			select {
+			case listener.requestChannel <- requestPackage{
 				conn: nil,
 				req:  nil,
 				err:  err,
+			}:
+			case <-listener.done:
 			}
 
 			return
@@ -94,14 +161,17 @@ func handleUDPListening(listener *Listener) {
 		data := make([]byte, 65535)
 		n, addr, err := listener.udpListener.ReadFrom(data)
 		if err != nil {
-			if listener.closed {
+			if listener.isClosed() {
 				return
 			}
 
-			listener.requestChannel <- requestPackage{
+			select {
+			case listener.requestChannel <- requestPackage{
 				conn: nil,
 				req:  nil,
 				err:  err,
+			}:
+			case <-listener.done:
 			}
 
 			return
@@ -114,37 +184,72 @@ func handleUDPListening(listener *Listener) {
 // AcceptRequest blocks until it receives a Request message on either TCP or UDP
 // listeners. Responses are to be written to *Conn (and then flushed).
 func (l *Listener) AcceptRequest() (*Request, *Conn, error) {
-	for {
-		if l.closed {
-			return nil, nil, ErrClosed
-		}
-		resp := <-l.requestChannel
+	return l.AcceptRequestContext(context.Background())
+}
+
+// AcceptRequestContext is like AcceptRequest, but returns the context's
+// error if ctx is done before a request is received. ErrClosed is returned
+// once the listener is closed.
+func (l *Listener) AcceptRequestContext(ctx context.Context) (*Request,
+	*Conn, error) {
+	if l.isClosed() {
+		return nil, nil, ErrClosed
+	}
+
+	select {
+	case resp := <-l.requestChannel:
 		return resp.req, resp.conn, resp.err
+	case <-l.done:
+		return nil, nil, ErrClosed
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
 	}
 }
 
-// Close closes both TCP and UDP listeners, and returns
+// Close closes both TCP and UDP listeners and all of their connections,
+// and returns the first error encountered closing the listeners. Blocked
+// calls to AcceptRequest return ErrClosed.
 func (l *Listener) Close() error {
-	l.closed = true
-	err := l.tcpListener.Close()
-	if err != nil {
-		l.udpListener.Close()
-	} else {
-		err = l.udpListener.Close()
-	}
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.tcpListener.Close()
+		if err != nil {
+			l.udpListener.Close()
+		} else {
+			err = l.udpListener.Close()
+		}
 
-closeLoop:
-	for {
-		select {
-		case <-l.requestChannel:
-		default:
-			break closeLoop
+		var conns []*Conn
+		l.udpPoolMutex.Lock()
+		for _, conn := range l.udpPool {
+			conns = append(conns, conn)
 		}
-	}
+		l.udpPoolMutex.Unlock()
+
+		l.tcpConnsMutex.Lock()
+		for conn := range l.tcpConns {
+			conns = append(conns, conn)
+		}
+		l.tcpConnsMutex.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
 
 	return err
 }
 
+func (l *Listener) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Addr returns the address the listener is listening on.
 func (l *Listener) Addr() net.Addr {
 	return l.tcpListener.Addr()
@@ -0,0 +1,209 @@
+package sipnet
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// Message is implemented by *Request and *Response, and provides access to
+// the parts which are common to both.
+type Message interface {
+	// StartLine returns the request line or status line of the message,
+	// without its CRLF.
+	StartLine() string
+
+	// MessageHeader returns the header of the message, which may be
+	// modified.
+	MessageHeader() *Header
+
+	// MessageBody returns the body of the message.
+	MessageBody() []byte
+
+	// SetBody sets the body of the message, and its Content-Type and
+	// Content-Length.
+	SetBody(contentType string, body []byte)
+
+	// CallID returns the value of the Call-ID header.
+	CallID() string
+
+	// CSeq parses the CSeq header.
+	CSeq() (CSeq, error)
+
+	// From and To parse the From and To headers.
+	From() (User, error)
+	To() (User, error)
+
+	// Vias parses the Via headers.
+	Vias() (ViaStack, error)
+
+	// Marshal returns the wire representation of the message.
+	Marshal() []byte
+
+	// AppendTo writes the wire representation of the message to a writer.
+	AppendTo(w io.Writer) (int64, error)
+}
+
+var (
+	_ Message = (*Request)(nil)
+	_ Message = (*Response)(nil)
+)
+
+// marshalMessage returns the wire representation of a message. The
+// Content-Length is set on a copy of the header, so h is not modified.
+func marshalMessage(startLine string, h *Header, body []byte,
+	compact bool) []byte {
+	header := h.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(startLine + "\r\n")
+	if compact {
+		header.WriteCompactTo(buf)
+	} else {
+		header.WriteTo(buf)
+	}
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+func setBody(h *Header, contentType string, body []byte) {
+	if contentType == "" {
+		h.Del("Content-Type")
+	} else {
+		h.Set("Content-Type", contentType)
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+func versionOrDefault(version string) string {
+	if version == "" {
+		return SIPVersion
+	}
+
+	return version
+}
+
+// StartLine returns the request line of the request.
+func (r *Request) StartLine() string {
+	return r.Method + " " + r.URI.String() + " " + versionOrDefault(r.SIPVersion)
+}
+
+// MessageHeader returns the header of the request.
+func (r *Request) MessageHeader() *Header {
+	return &r.Header
+}
+
+// MessageBody returns the body of the request.
+func (r *Request) MessageBody() []byte {
+	return r.Body
+}
+
+// SetBody sets the body of the request, and its Content-Type and
+// Content-Length. The Content-Type is removed if it is empty.
+func (r *Request) SetBody(contentType string, body []byte) {
+	setBody(&r.Header, contentType, body)
+	r.Body = body
+}
+
+// CallID returns the value of the Call-ID header.
+func (r *Request) CallID() string {
+	return r.Header.Get("Call-ID")
+}
+
+// CSeq parses the CSeq header of the request.
+func (r *Request) CSeq() (CSeq, error) {
+	return ParseCSeq(r.Header.Get("CSeq"))
+}
+
+// From parses the From header of the request.
+func (r *Request) From() (User, error) {
+	return ParseUser(r.Header.Get("From"))
+}
+
+// To parses the To header of the request.
+func (r *Request) To() (User, error) {
+	return ParseUser(r.Header.Get("To"))
+}
+
+// Vias parses the Via headers of the request.
+func (r *Request) Vias() (ViaStack, error) {
+	return ParseViaStack(&r.Header)
+}
+
+// Marshal returns the wire representation of the request, with a
+// Content-Length matching the body. The request is not modified.
+func (r *Request) Marshal() []byte {
+	return marshalMessage(r.StartLine(), &r.Header, r.Body, r.CompactHeaders)
+}
+
+// AppendTo writes the wire representation of the request to a writer in a
+// single write. Unlike WriteTo, it does not flush the writer.
+func (r *Request) AppendTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.Marshal())
+	return int64(n), err
+}
+
+// StartLine returns the status line of the response.
+func (r *Response) StartLine() string {
+	return versionOrDefault(r.SIPVersion) + " " + strconv.Itoa(r.StatusCode) +
+		" " + r.reasonPhrase()
+}
+
+// MessageHeader returns the header of the response.
+func (r *Response) MessageHeader() *Header {
+	return &r.Header
+}
+
+// MessageBody returns the body of the response.
+func (r *Response) MessageBody() []byte {
+	return r.Body
+}
+
+// SetBody sets the body of the response, and its Content-Type and
+// Content-Length. The Content-Type is removed if it is empty.
+func (r *Response) SetBody(contentType string, body []byte) {
+	setBody(&r.Header, contentType, body)
+	r.Body = body
+}
+
+// CallID returns the value of the Call-ID header.
+func (r *Response) CallID() string {
+	return r.Header.Get("Call-ID")
+}
+
+// CSeq parses the CSeq header of the response.
+func (r *Response) CSeq() (CSeq, error) {
+	return ParseCSeq(r.Header.Get("CSeq"))
+}
+
+// From parses the From header of the response.
+func (r *Response) From() (User, error) {
+	return ParseUser(r.Header.Get("From"))
+}
+
+// To parses the To header of the response.
+func (r *Response) To() (User, error) {
+	return ParseUser(r.Header.Get("To"))
+}
+
+// Vias parses the Via headers of the response.
+func (r *Response) Vias() (ViaStack, error) {
+	return ParseViaStack(&r.Header)
+}
+
+// Marshal returns the wire representation of the response, with a
+// Content-Length matching the body. The response is not modified.
+func (r *Response) Marshal() []byte {
+	return marshalMessage(r.StartLine(), &r.Header, r.Body, r.CompactHeaders)
+}
+
+// AppendTo writes the wire representation of the response to a writer in
+// a single write. Unlike WriteTo, it does not copy any headers from a
+// request or send the response in its transaction.
+func (r *Response) AppendTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.Marshal())
+	return int64(n), err
+}
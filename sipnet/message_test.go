@@ -0,0 +1,87 @@
+package sipnet
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestMessageSetBody(t *testing.T) {
+	req := testRequest(MethodInvite)
+	resp := NewResponseFor(req, StatusOK, "")
+
+	for _, c := range []struct {
+		msg  Message
+		read func([]byte) (Message, error)
+	}{
+		{req, func(data []byte) (Message, error) {
+			return ReadRequest(bytes.NewReader(data))
+		}},
+		{resp, func(data []byte) (Message, error) {
+			return ReadResponse(bytes.NewReader(data))
+		}},
+	} {
+		for _, body := range []struct {
+			contentType string
+			data        string
+		}{
+			{"application/sdp", "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\n"},
+			{"text/plain", "hi"},
+			{"", ""},
+		} {
+			c.msg.SetBody(body.contentType, []byte(body.data))
+			if got, want := c.msg.MessageHeader().Get("Content-Length"),
+				strconv.Itoa(len(body.data)); got != want {
+				t.Errorf("got Content-Length %q, want %q", got, want)
+			}
+
+			data := c.msg.Marshal()
+			parsed, err := c.read(data)
+			if err != nil {
+				t.Fatalf("failed to read %q: %v", data, err)
+			}
+
+			if string(parsed.MessageBody()) != body.data ||
+				parsed.MessageHeader().Get("Content-Type") != body.contentType {
+				t.Errorf("got %q, want body %q of type %q", data, body.data,
+					body.contentType)
+			}
+
+			if again := parsed.Marshal(); !bytes.Equal(again, data) {
+				t.Errorf("round trip changed %q to %q", data, again)
+			}
+		}
+	}
+}
+
+func TestMessageMarshal(t *testing.T) {
+	req := testRequest(MethodMessage)
+	req.Header.Set("Content-Length", "99")
+	req.Body = []byte("hello")
+
+	// Marshal writes the length of the body without changing the header.
+	parsed, err := ReadRequest(bytes.NewReader(req.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Header.Get("Content-Length") != "5" ||
+		string(parsed.Body) != "hello" {
+		t.Fatalf("got %q, want a body of 5 bytes", req.Marshal())
+	}
+
+	if req.Header.Get("Content-Length") != "99" {
+		t.Fatal("Marshal changed the Content-Length of the request")
+	}
+
+	for _, msg := range []Message{req, NewResponseFor(req, StatusOK, "")} {
+		// AppendTo appends to what the writer already holds.
+		buf := bytes.NewBufferString("existing data\r\n")
+		n, err := msg.AppendTo(buf)
+		want := "existing data\r\n" + string(msg.Marshal())
+		if err != nil || n != int64(len(msg.Marshal())) ||
+			buf.String() != want {
+			t.Errorf("got %q, %d, %v, want %q", buf.String(), n, err, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package sipnet
+
+import (
+	"log"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Middleware wraps a Handler with behaviour which is shared by many
+// handlers, such as authentication or logging.
+type Middleware func(next Handler) Handler
+
+// Chain returns a handler which passes requests through the middlewares in
+// order before the handler, so the first middleware is the outermost.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Recovery is a Middleware which recovers from panics in the handler. The
+// panic is logged with its stack trace, and the request is responded to
+// with a 500 Server Internal Error unless it is an ACK or the handler
+// already sent a final response.
+func Recovery(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("sip: panic serving %s %s from %s: %v\n%s",
+					req.Method, req.URI.String(), w.Conn().Addr(), err,
+					debug.Stack())
+
+				if req.Method != MethodAck {
+					w.WriteStatus(StatusServerInternalError, "")
+				}
+			}
+		}()
+
+		next.ServeSIP(w, req)
+	})
+}
+
+// Logging returns a Middleware which logs every request with the status
+// code of the last response it was responded with, and the time the
+// handler took. If logger is nil, the standard logger is used.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, req: req}
+			next.ServeSIP(sw, req)
+
+			status := "no response"
+			if sw.status != 0 {
+				status = strconv.Itoa(sw.status)
+			}
+
+			logger.Printf("sip: %s %s from %s %s: %s in %v", req.Method,
+				req.URI.String(), w.Conn().Transport, w.Conn().Addr(), status,
+				time.Since(start))
+		})
+	}
+}
+
+// statusWriter is a ResponseWriter which records the status code of the
+// last response sent.
+type statusWriter struct {
+	ResponseWriter
+	req    *Request
+	status int
+}
+
+func (w *statusWriter) Respond(resp *Response) error {
+	err := w.ResponseWriter.Respond(resp)
+	if err == nil {
+		w.status = resp.StatusCode
+	}
+
+	return err
+}
+
+func (w *statusWriter) WriteStatus(code int, reason string) error {
+	return w.Respond(NewResponseFor(w.req, code, reason))
+}
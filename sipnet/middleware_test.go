@@ -0,0 +1,80 @@
+package sipnet
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// recorder is a ResponseWriter which records the responses sent.
+type recorder struct {
+	req       *Request
+	responses []*Response
+}
+
+func (r *recorder) Conn() *Conn {
+	return &Conn{Transport: "udp", Address: &net.UDPAddr{IP: net.IPv4(192, 0,
+		2, 1), Port: 5060}}
+}
+
+func (r *recorder) Transaction() *ServerTransaction {
+	return nil
+}
+
+func (r *recorder) Respond(resp *Response) error {
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+func (r *recorder) WriteStatus(code int, reason string) error {
+	return r.Respond(NewResponseFor(r.req, code, reason))
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(w ResponseWriter, req *Request) {
+				order = append(order, name)
+				next.ServeSIP(w, req)
+			})
+		}
+	}
+
+	handler := Chain(HandlerFunc(func(w ResponseWriter, req *Request) {
+		order = append(order, "handler")
+	}), middleware("a"), middleware("b"))
+
+	req := testRequest(MethodOptions)
+	handler.ServeSIP(&recorder{req: req}, req)
+	if strings.Join(order, " ") != "a b handler" {
+		t.Fatalf("got order %v", order)
+	}
+}
+
+func TestRecoveryAndLogging(t *testing.T) {
+	buf := new(bytes.Buffer)
+	handler := Chain(HandlerFunc(func(w ResponseWriter, req *Request) {
+		panic("oops")
+	}), Logging(log.New(buf, "", 0)), Recovery)
+
+	// Silence the panic logged by Recovery.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(new(bytes.Buffer))
+
+	req := testRequest(MethodInvite)
+	w := &recorder{req: req}
+	handler.ServeSIP(w, req)
+
+	if len(w.responses) != 1 ||
+		w.responses[0].StatusCode != StatusServerInternalError {
+		t.Fatalf("got responses %v, want a 500", w.responses)
+	}
+
+	if !strings.Contains(buf.String(), "INVITE sip:bob@127.0.0.1 from udp "+
+		"192.0.2.1:5060: 500") {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
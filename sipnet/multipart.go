@@ -0,0 +1,203 @@
+package sipnet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadMultipart is returned when a multipart body fails to be parsed.
+var ErrBadMultipart = errors.New("sip: malformed multipart body")
+
+// Part represents a single body part of a multipart body (RFC 2046
+// section 5.1), such as the SDP of a multipart/mixed INVITE.
+type Part struct {
+	Header Header
+	Body   []byte
+}
+
+// NewPart returns a new part with a Content-Type and body.
+func NewPart(contentType string, body []byte) Part {
+	var p Part
+	p.Header.Set("Content-Type", contentType)
+	p.Body = body
+	return p
+}
+
+// ContentType parses the Content-Type of the part. A part without a
+// Content-Type is text/plain.
+func (p *Part) ContentType() (MediaType, error) {
+	value, found := p.Header.First("Content-Type")
+	if !found {
+		return MediaType{Type: "text", Subtype: "plain"}, nil
+	}
+
+	return ParseContentType(value)
+}
+
+// Parts parses the body of a part which is itself a multipart body.
+func (p *Part) Parts() ([]Part, error) {
+	mediaType, err := p.ContentType()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMultipart(mediaType, p.Body)
+}
+
+// ParseMultipart parses a multipart body with a Content-Type, such as
+// "multipart/mixed;boundary=abc", into its parts.
+func ParseMultipart(contentType string, body []byte) ([]Part, error) {
+	mediaType, err := ParseContentType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMultipart(mediaType, body)
+}
+
+// MessageParts parses the multipart body of a message into its parts,
+// according to the message's Content-Type.
+func MessageParts(m Message) ([]Part, error) {
+	return ParseMultipart(m.MessageHeader().Get("Content-Type"),
+		m.MessageBody())
+}
+
+func parseMultipart(mediaType MediaType, body []byte) ([]Part, error) {
+	boundary := mediaType.Params.Get("boundary")
+	if mediaType.Type != "multipart" || boundary == "" {
+		return nil, headerError("Content-Type", mediaType.String(),
+			"expected a multipart type with a boundary")
+	}
+
+	rawParts, err := splitMultipart(body, "--"+boundary)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]Part, 0, len(rawParts))
+	for _, raw := range rawParts {
+		rd := &lineReader{Reader: bufio.NewReader(bytes.NewReader(raw))}
+
+		var p Part
+		if err := DefaultParserConfig.parseHeader(rd, &p.Header); err != nil {
+			return nil, ErrBadMultipart
+		}
+
+		p.Body = raw[rd.next:]
+		parts = append(parts, p)
+	}
+
+	return parts, nil
+}
+
+// splitMultipart splits a multipart body into the raw parts between its
+// delimiter lines, ignoring the preamble and epilogue.
+func splitMultipart(body []byte, dashBoundary string) ([][]byte, error) {
+	delimiter := []byte("\n" + dashBoundary)
+
+	// The first delimiter may be at the very start of the body.
+	var start int
+	if bytes.HasPrefix(body, delimiter[1:]) {
+		start = len(delimiter) - 1
+	} else if i := bytes.Index(body, delimiter); i >= 0 {
+		start = i + len(delimiter)
+	} else {
+		return nil, ErrBadMultipart
+	}
+
+	var parts [][]byte
+	for {
+		rest := body[start:]
+		if bytes.HasPrefix(rest, []byte("--")) {
+			return parts, nil
+		}
+
+		// Skip any transport padding after the delimiter.
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 || strings.Trim(string(rest[:end]), " \t\r") != "" {
+			return nil, ErrBadMultipart
+		}
+
+		content := rest[end+1:]
+		next := bytes.Index(content, delimiter)
+		if next < 0 {
+			return nil, ErrBadMultipart
+		}
+
+		part := content[:next]
+		if bytes.HasSuffix(part, []byte("\r")) {
+			part = part[:len(part)-1]
+		}
+
+		parts = append(parts, part)
+		body = content
+		start = next + len(delimiter)
+	}
+}
+
+// Multipart builds a multipart body.
+type Multipart struct {
+	// Subtype is the subtype of the multipart media type, such as
+	// "mixed" or "alternative". If empty, "mixed" is used.
+	Subtype string
+
+	// Boundary is the boundary between the parts. A random boundary is
+	// generated if it is empty, or one from the current time if the
+	// system's random number generator fails.
+	Boundary string
+	Parts    []Part
+}
+
+// ContentType returns the Content-Type of the multipart body.
+func (m *Multipart) ContentType() MediaType {
+	if m.Boundary == "" {
+		boundary, err := randomToken(16)
+		if err != nil {
+			// The boundary only needs to be unlikely to appear in the parts.
+			boundary = strconv.FormatInt(time.Now().UnixNano(), 36)
+		}
+
+		m.Boundary = boundary
+	}
+
+	subtype := m.Subtype
+	if subtype == "" {
+		subtype = "mixed"
+	}
+
+	mediaType := MediaType{Type: "multipart", Subtype: subtype}
+	mediaType.Params.Set("boundary", m.Boundary)
+	return mediaType
+}
+
+// Marshal returns the multipart body.
+func (m *Multipart) Marshal() []byte {
+	dashBoundary := "--" + m.ContentType().Params.Get("boundary")
+
+	buf := new(bytes.Buffer)
+	for _, p := range m.Parts {
+		buf.WriteString(dashBoundary + "\r\n")
+		p.Header.WriteTo(buf)
+		buf.Write(p.Body)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString(dashBoundary + "--\r\n")
+
+	return buf.Bytes()
+}
+
+// Part returns the multipart body as a part, so that it can be nested in
+// another multipart body.
+func (m *Multipart) Part() Part {
+	return NewPart(m.ContentType().String(), m.Marshal())
+}
+
+// SetMessageBody sets the body of a message to the multipart body, along
+// with its Content-Type and Content-Length.
+func (m *Multipart) SetMessageBody(msg Message) {
+	msg.SetBody(m.ContentType().String(), m.Marshal())
+}
@@ -0,0 +1,111 @@
+package sipnet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseMultipart(t *testing.T) {
+	body := "preamble\r\n" +
+		"--7a9cbec02ceef655\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n" +
+		"\r\n" +
+		"--7a9cbec02ceef655  \r\n" +
+		"\r\n" +
+		"plain text\r\n" +
+		"--7a9cbec02ceef655--\r\n" +
+		"epilogue"
+
+	parts, err := ParseMultipart("multipart/mixed;boundary=7a9cbec02ceef655",
+		[]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+
+	if mediaType, _ := parts[0].ContentType(); mediaType.String() !=
+		"application/sdp" {
+		t.Errorf("got Content-Type %q", mediaType.String())
+	}
+
+	if string(parts[0].Body) != "v=0\r\n" {
+		t.Errorf("got body %q", parts[0].Body)
+	}
+
+	if mediaType, _ := parts[1].ContentType(); mediaType.String() !=
+		"text/plain" {
+		t.Errorf("got default Content-Type %q", mediaType.String())
+	}
+
+	if string(parts[1].Body) != "plain text" {
+		t.Errorf("got body %q", parts[1].Body)
+	}
+
+	for _, bad := range []string{
+		"",
+		"--7a9cbec02ceef655\r\n\r\nunterminated",
+		"--7a9cbec02ceef655 junk\r\n\r\nx\r\n--7a9cbec02ceef655--",
+	} {
+		_, err := ParseMultipart("multipart/mixed;boundary=7a9cbec02ceef655",
+			[]byte(bad))
+		if err != ErrBadMultipart {
+			t.Errorf("%q: got error %v", bad, err)
+		}
+	}
+
+	if _, err := ParseMultipart("application/sdp", []byte(body)); err == nil {
+		t.Error("non-multipart Content-Type was accepted")
+	}
+}
+
+func TestMultipartNested(t *testing.T) {
+	alternative := &Multipart{
+		Subtype: "alternative",
+		Parts: []Part{
+			NewPart("text/plain", []byte("hello")),
+			NewPart("text/html", []byte("<b>hello</b>")),
+		},
+	}
+
+	mixed := &Multipart{
+		Parts: []Part{
+			NewPart("application/sdp", []byte("v=0\r\n")),
+			alternative.Part(),
+		},
+	}
+
+	req := NewRequest()
+	mixed.SetMessageBody(req)
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/mixed;") {
+		t.Errorf("got Content-Type %q", req.Header.Get("Content-Type"))
+	}
+
+	parts, err := MessageParts(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 2 || string(parts[0].Body) != "v=0\r\n" {
+		t.Fatalf("got parts %v", parts)
+	}
+
+	nested, err := parts[1].Parts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nested) != 2 || string(nested[0].Body) != "hello" ||
+		string(nested[1].Body) != "<b>hello</b>" {
+		t.Errorf("got nested parts %v", nested)
+	}
+
+	if !bytes.Equal(parts[1].Body, alternative.Marshal()) {
+		t.Errorf("nested body changed to %q", parts[1].Body)
+	}
+}
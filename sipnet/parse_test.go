@@ -0,0 +1,560 @@
+package sipnet
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// parseCase is the expected result of parsing a string. If out is empty,
+// the string is expected to be rejected. Otherwise out is the expected text
+// representation of the parsed value.
+type parseCase struct {
+	in  string
+	out string
+}
+
+func checkParse(t *testing.T, cases []parseCase,
+	parse func(string) (string, error)) {
+	t.Helper()
+	for _, c := range cases {
+		out, err := parse(c.in)
+		if c.out == "" {
+			if err == nil {
+				t.Errorf("%q: got %q, want error", c.in, out)
+			} else if !errors.Is(err, ErrParseError) {
+				t.Errorf("%q: error %v does not match ErrParseError", c.in, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.in, err)
+		} else if out != c.out {
+			t.Errorf("%q: got %q, want %q", c.in, out, c.out)
+		}
+
+		// The text representation must parse to itself.
+		if again, err := parse(out); err != nil || again != out {
+			t.Errorf("%q: round trip got %q, %v", out, again, err)
+		}
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	checkParse(t, []parseCase{
+		{"sip:alice@atlanta.com", "sip:alice@atlanta.com"},
+		{"sip:alice:secretword@atlanta.com;transport=tcp",
+			"sip:alice:secretword@atlanta.com;transport=tcp"},
+		{"sips:alice@atlanta.com?subject=project%20x&priority=urgent",
+			"sips:alice@atlanta.com?subject=project%20x&priority=urgent"},
+		{"sip:+1-212-555-1212:1234@gateway.com;user=phone",
+			"sip:+1-212-555-1212:1234@gateway.com;user=phone"},
+		{"sips:1212@gateway.com", "sips:1212@gateway.com"},
+		{"sip:alice@192.0.2.4", "sip:alice@192.0.2.4"},
+		{"sip:atlanta.com;method=REGISTER?to=alice%40atlanta.com",
+			"sip:atlanta.com;method=REGISTER?to=alice%40atlanta.com"},
+		{"sip:alice;day=tuesday@atlanta.com", "sip:alice;day=tuesday@atlanta.com"},
+		{"sip:[2001:db8::1]:5060;lr", "sip:[2001:db8::1]:5060;lr"},
+		{"sip:alice@atlanta.com:0", "sip:alice@atlanta.com:0"},
+		{"sip:alice@atlanta.com:05060", "sip:alice@atlanta.com:05060"},
+		{"sip:[2001:db8::1]:00", "sip:[2001:db8::1]:00"},
+		{"sip:%61lice@atlanta.com", "sip:%61lice@atlanta.com"},
+		{"SIP:alice@atlanta.com", "SIP:alice@atlanta.com"},
+		{"tel:+1-201-555-0123", "tel:+1-201-555-0123"},
+		{"mailto:alice@atlanta.com", "mailto:alice@atlanta.com"},
+		{"sip:", ""},
+		{"sip:alice@", ""},
+		{"sip:alice@atlanta.com:port", ""},
+		{"sip:alice@atlanta.com:99999", ""},
+		{"sip:alice@[2001:db8::1", ""},
+		{"sip:al ice@atlanta.com", ""},
+		{"sip:alice@atlanta.com;a=%zz", ""},
+		{"<sip:alice@atlanta.com>", ""},
+		{"alice@atlanta.com", ""},
+		{"tel:12", ""},
+		{"foo:", ""},
+		{"foo:a\fb", ""},
+	}, func(str string) (string, error) {
+		u, err := ParseURI(str)
+		return u.String(), err
+	})
+}
+
+func TestURIPort(t *testing.T) {
+	u, err := ParseURI("sip:alice@atlanta.com:05060")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Port != 5060 {
+		t.Fatalf("got port %d, want 5060", u.Port)
+	}
+
+	// A changed port is written in its canonical form.
+	for _, c := range []struct {
+		port int
+		want string
+	}{
+		{5060, "sip:alice@atlanta.com:05060"},
+		{5061, "sip:alice@atlanta.com:5061"},
+		{0, "sip:alice@atlanta.com"},
+	} {
+		u.Port = c.port
+		if got := u.String(); got != c.want {
+			t.Errorf("port %d: got %q, want %q", c.port, got, c.want)
+		}
+	}
+}
+
+func TestURIEqual(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"sip:%61lice@atlanta.com;transport=TCP",
+			"sip:alice@AtLanTa.CoM;Transport=tcp", true},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com;newparam=5", true},
+		{"sip:carol@chicago.com;security=on", "sip:carol@chicago.com;newparam=5", true},
+		{"sip:biloxi.com;transport=tcp;method=REGISTER?to=sip:bob%40biloxi.com",
+			"sip:biloxi.com;method=REGISTER;transport=tcp?to=sip:bob%40biloxi.com", true},
+		{"sip:alice@atlanta.com?subject=project%20x&priority=urgent",
+			"sip:alice@atlanta.com?priority=urgent&subject=project%20x", true},
+		{"SIP:ALICE@AtLanTa.CoM;Transport=udp", "sip:alice@AtLanTa.CoM;Transport=UDP", false},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com:5060", false},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com;transport=udp", false},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com:6000;transport=tcp", false},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com?Subject=next%20meeting", false},
+		{"sip:bob@phone21.boxesbybob.com", "sip:bob@192.0.2.4", false},
+		{"sip:carol@chicago.com;security=on", "sip:carol@chicago.com;security=off", false},
+		{"tel:+1-201-555-0123", "tel:+12015550123", true},
+	} {
+		a, err := ParseURI(c.a)
+		if err != nil {
+			t.Fatalf("%q: %v", c.a, err)
+		}
+
+		b, err := ParseURI(c.b)
+		if err != nil {
+			t.Fatalf("%q: %v", c.b, err)
+		}
+
+		if a.Equal(b) != c.equal || b.Equal(a) != c.equal {
+			t.Errorf("%q == %q: got %v, want %v", c.a, c.b, !c.equal, c.equal)
+		}
+	}
+}
+
+func TestParseTelURI(t *testing.T) {
+	checkParse(t, []parseCase{
+		{"tel:+1-201-555-0123", "tel:+12015550123"},
+		{"tel:7042;phone-context=example.com", "tel:7042;phone-context=example.com"},
+		{"tel:863-1234;phone-context=+1-914-555",
+			"tel:8631234;phone-context=+1914555"},
+		{"tel:+1-201-555-0123;ext=22;isub=abc;foo=bar",
+			"tel:+12015550123;ext=22;isub=abc;foo=bar"},
+		{"tel:7042", ""},
+		{"tel:+", ""},
+		{"tel:+1-201-555-0123;ext=", ""},
+		{"sip:+1-201-555-0123", ""},
+	}, func(str string) (string, error) {
+		tel, err := ParseTelURI(str)
+		return tel.String(), err
+	})
+}
+
+func TestTelURISIPURI(t *testing.T) {
+	for _, c := range []struct {
+		tel  string
+		want string
+	}{
+		{"tel:+1-201-555-0123",
+			"sip:+12015550123@gateway.com;user=phone"},
+		{"tel:+1(201)555.0123;ext=2-2",
+			"sip:+12015550123;ext=22@gateway.com;user=phone"},
+		{"tel:863-1234;phone-context=+1-914-555",
+			"sip:8631234;phone-context=+1914555@gateway.com;user=phone"},
+		{"tel:7042;phone-context=example.com",
+			"sip:7042;phone-context=example.com@gateway.com;user=phone"},
+		{"tel:+1-201-555-0123;isub=a%20b;foo=b[a]r",
+			"sip:+12015550123;isub=a%20b;foo=b%5Ba%5Dr@gateway.com;user=phone"},
+	} {
+		tel, err := ParseTelURI(c.tel)
+		if err != nil {
+			t.Fatalf("%q: %v", c.tel, err)
+		}
+
+		u := tel.SIPURI("gateway.com")
+		if got := u.String(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.tel, got, c.want)
+		}
+
+		// The SIP URI converts back to the tel URI, both as built and as
+		// parsed.
+		parsed, err := ParseURI(u.String())
+		if err != nil {
+			t.Fatalf("%q: %v", u.String(), err)
+		}
+
+		for _, u := range []URI{u, parsed} {
+			if back, err := u.TelURI(); err != nil || !back.Equal(tel) {
+				t.Errorf("%q: got %q, %v, want %q", u.String(), back, err,
+					tel)
+			}
+		}
+	}
+}
+
+func TestParseVia(t *testing.T) {
+	checkParse(t, []parseCase{
+		{"SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds",
+			"SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds"},
+		{"SIP / 2.0 / TCP  192.0.2.1:5060 ; rport ; branch = z9hG4bK1",
+			"SIP/2.0/TCP 192.0.2.1:5060;rport;branch=z9hG4bK1"},
+		{"SIP/2.0/UDP [2001:db8::1]:5060;received=2001:db8::2",
+			"SIP/2.0/UDP [2001:db8::1]:5060;received=2001:db8::2"},
+		{"SIP/2.0/UDP host;x=\"a b\"", "SIP/2.0/UDP host;x=\"a b\""},
+		{"SIP/2.0/UDP", ""},
+		{"SIP/2.0 host", ""},
+		{"SIP/2.0/UDP host;;", ""},
+		{"SIP/2.0/UDP host:port", ""},
+		{"SIP/2.0/UDP 192.0.2.15;;,;,,", ""},
+	}, func(str string) (string, error) {
+		v, err := ParseVia(str)
+		return v.String(), err
+	})
+}
+
+func TestViaSetReceived(t *testing.T) {
+	for _, c := range []struct {
+		via  string
+		addr string
+		want string
+	}{
+		{"SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1", "192.0.2.1:5060",
+			"SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1"},
+		{"SIP/2.0/UDP pc33.example.com;branch=z9hG4bK1", "192.0.2.4:5060",
+			"SIP/2.0/UDP pc33.example.com;branch=z9hG4bK1;received=192.0.2.4"},
+		{"SIP/2.0/UDP 192.0.2.1;received=192.0.2.9", "192.0.2.4:5060",
+			"SIP/2.0/UDP 192.0.2.1;received=192.0.2.4"},
+		{"SIP/2.0/UDP 192.0.2.1;rport;branch=z9hG4bK1", "192.0.2.1:5062",
+			"SIP/2.0/UDP 192.0.2.1;rport=5062;branch=z9hG4bK1;received=192.0.2.1"},
+		{"SIP/2.0/UDP pc33.example.com;rport", "192.0.2.4:5062",
+			"SIP/2.0/UDP pc33.example.com;rport=5062;received=192.0.2.4"},
+		{"SIP/2.0/UDP 192.0.2.1;rport=5060", "192.0.2.1:5062",
+			"SIP/2.0/UDP 192.0.2.1;rport=5060"},
+		{"SIP/2.0/UDP 192.0.2.1;rport=5060", "192.0.2.4:5062",
+			"SIP/2.0/UDP 192.0.2.1;rport=5060;received=192.0.2.4"},
+		{"SIP/2.0/UDP [2001:db8::1]:5060", "[2001:db8:0::1]:5060",
+			"SIP/2.0/UDP [2001:db8::1]:5060"},
+		{"SIP/2.0/UDP [2001:db8::1]:5060", "[2001:db8::2]:5060",
+			"SIP/2.0/UDP [2001:db8::1]:5060;received=2001:db8::2"},
+		{"SIP/2.0/TCP [2001:db8::1];rport", "[2001:db8::1]:5062",
+			"SIP/2.0/TCP [2001:db8::1];rport=5062;received=2001:db8::1"},
+	} {
+		v, err := ParseVia(c.via)
+		if err != nil {
+			t.Fatalf("%q: %v", c.via, err)
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.SetReceived(addr)
+		if got := v.String(); got != c.want {
+			t.Errorf("%q from %s: got %q, want %q", c.via, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestParseUser(t *testing.T) {
+	checkParse(t, []parseCase{
+		{"Alice <sip:alice@atlanta.com>;tag=1928301774",
+			"Alice <sip:alice@atlanta.com>;tag=1928301774"},
+		{"\"Alice Smith\" <sip:alice@atlanta.com>",
+			"Alice Smith <sip:alice@atlanta.com>"},
+		{"\"Bell, Alexander\" <sip:a.g.bell@example.com>",
+			"\"Bell, Alexander\" <sip:a.g.bell@example.com>"},
+		{"\"J Rosenberg \\\\\\\"\" <sip:jdrosen@example.com>",
+			"\"J Rosenberg \\\\\\\"\" <sip:jdrosen@example.com>"},
+		{"caller<sip:caller@example.com>;tag=323",
+			"caller <sip:caller@example.com>;tag=323"},
+		{"sip:alice@atlanta.com;tag=1", "<sip:alice@atlanta.com>;tag=1"},
+		{"<sip:alice@atlanta.com;lr>", "<sip:alice@atlanta.com;lr>"},
+		{"<sip:alice@atlanta.com?subject=x>", "<sip:alice@atlanta.com?subject=x>"},
+		{"<tel:+1-201-555-0123>", "<tel:+1-201-555-0123>"},
+		{"Bell, Alexander <sip:a.g.bell@example.com>", ""},
+		{"\"Mr. J. User <sip:j.user@example.com>", ""},
+		{"<sip:alice@atlanta.com", ""},
+		{"sip:alice@atlanta.com;;", ""},
+		{"< sip:t.watson@example.org >", ""},
+		{"sip:alice@atlanta.com?subject=x", ""},
+		{"", ""},
+	}, func(str string) (string, error) {
+		u, err := ParseUser(str)
+		return u.String(), err
+	})
+}
+
+func TestParseUserList(t *testing.T) {
+	users, err := ParseUserList("\"a, b\" <sip:a@example.com>, " +
+		"sip:b@example.com;q=0.5 ,<sip:c@example.com;lr>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, user := range users {
+		got = append(got, user.String())
+	}
+
+	want := "\"a, b\" <sip:a@example.com>|<sip:b@example.com>;q=0.5|" +
+		"<sip:c@example.com;lr>"
+	if strings.Join(got, "|") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, "|"), want)
+	}
+
+	if _, err := ParseUserList(""); err == nil {
+		t.Error("empty list was accepted")
+	}
+}
+
+func TestParsePairs(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want HeaderArgs
+	}{
+		{"realm=\"atlanta.com\", qop=auth",
+			HeaderArgs{{"realm", "atlanta.com", true}, {"qop", "auth", false}}},
+		{"k=", HeaderArgs{{"k", "", false}}},
+		{"k=\"\"", HeaderArgs{{"k", "", true}}},
+		{"=v", HeaderArgs{{"", "v", false}}},
+		{"lr;transport=tcp", HeaderArgs{{"lr", "", false},
+			{"transport", "tcp", false}}},
+		{"a=\"x,y;z\";b", HeaderArgs{{"a", "x,y;z", true}, {"b", "", false}}},
+		{";;,,;;,;", nil},
+		{"", nil},
+	} {
+		got := ParsePairs(c.in)
+		if len(got) != len(c.want) {
+			t.Errorf("%q: got %v, want %v", c.in, got, c.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%q: got %v, want %v", c.in, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHeaderValues(t *testing.T) {
+	checkParse(t, []parseCase{
+		{"314159 INVITE", "314159 INVITE"},
+		{"0009\t INVITE", "9 INVITE"},
+		{"4294967295 BYE", "4294967295 BYE"},
+		{"4294967296 BYE", ""},
+		{"-1 BYE", ""},
+		{"1", ""},
+		{"1 INVITE BYE", ""},
+	}, func(str string) (string, error) {
+		cseq, err := ParseCSeq(str)
+		return cseq.String(), err
+	})
+
+	checkParse(t, []parseCase{
+		{"application/SDP", "application/sdp"},
+		{"multipart/mixed ; boundary=\"a b\"", "multipart/mixed;boundary=\"a b\""},
+		{"text/plain;charset=utf-8", "text/plain;charset=utf-8"},
+		{"application", ""},
+		{"application/", ""},
+		{"application/sdp;", ""},
+	}, func(str string) (string, error) {
+		mediaType, err := ParseContentType(str)
+		return mediaType.String(), err
+	})
+
+	for _, c := range []struct {
+		in    string
+		value int
+		ok    bool
+	}{
+		{"70", 70, true},
+		{"0068", 68, true},
+		{"0", 0, true},
+		{"255", 255, true},
+		{"256", 0, false},
+		{"-1", 0, false},
+		{"+1", 0, false},
+		{"", 0, false},
+	} {
+		value, err := ParseMaxForwards(c.in)
+		if (err == nil) != c.ok || value != c.value {
+			t.Errorf("Max-Forwards %q: got %d, %v", c.in, value, err)
+		}
+	}
+}
+
+func TestParseContacts(t *testing.T) {
+	var h Header
+	h.Add("Contact", "<sip:a@example.com>;expires=60;q=0.5, sip:b@example.com")
+	contacts, err := ParseContacts(&h)
+	if err != nil || len(contacts) != 2 {
+		t.Fatalf("got %v, %v", contacts, err)
+	}
+
+	expires, found, err := contacts[0].Expires()
+	if expires != 60 || !found || err != nil {
+		t.Errorf("got expires %d, %v, %v", expires, found, err)
+	}
+
+	if q, err := contacts[0].Q(); q != 0.5 || err != nil {
+		t.Errorf("got q %v, %v", q, err)
+	}
+
+	if q, err := contacts[1].Q(); q != 1 || err != nil {
+		t.Errorf("got default q %v, %v", q, err)
+	}
+
+	for _, c := range []struct {
+		in  string
+		out float64
+		ok  bool
+	}{
+		{"0", 0, true}, {"1", 1, true}, {"0.", 0, true}, {"0.125", 0.125, true},
+		{"1.000", 1, true}, {"1.001", 0, false}, {"0.1234", 0, false},
+		{"NaN", 0, false}, {"Inf", 0, false}, {"0x.8p0", 0, false},
+		{".5", 0, false}, {"2", 0, false}, {"", 0, false},
+	} {
+		contact := Contact{User: contacts[1].User}
+		contact.Arguments.Set("q", c.in)
+		q, err := contact.Q()
+		if (err == nil) != c.ok || q != c.out {
+			t.Errorf("q=%q: got %v, %v", c.in, q, err)
+		}
+	}
+
+	h.Add("Contact", "*")
+	if _, err := ParseContacts(&h); err == nil {
+		t.Error("wildcard with other contacts was accepted")
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	const start = "OPTIONS sip:bob@example.com SIP/2.0\r\n"
+	for _, c := range []struct {
+		lines  []string
+		line   int
+		header string
+	}{
+		{[]string{"OPTIONS sip:bob@example.com\r\n", "l: 0\r\n", "\r\n"},
+			1, ""},
+		{[]string{start, "Via: SIP/2.0/UDP a\r\n", "No colon\r\n",
+			"l: 0\r\n", "\r\n"}, 3, "No"},
+		{[]string{start, "Bad Name: x\r\n", "\r\n"}, 2, "Bad Name"},
+		{[]string{start, "v: SIP/2.0/UDP a\n", "l: 0\r\n", "\r\n"}, 2, "Via"},
+		{[]string{start, "subject: a\r\n", " b\n", "l: 0\r\n", "\r\n"},
+			3, "Subject"},
+		{[]string{start, " orphan\r\n", "l: 0\r\n", "\r\n"}, 2, "orphan"},
+		{[]string{start, "Via: SIP/2.0/UDP a\r\n", "l: abc\r\n", "\r\n"},
+			3, "Content-Length"},
+	} {
+		msg := strings.Join(c.lines, "")
+		offset := len(strings.Join(c.lines[:c.line-1], ""))
+
+		_, err := (&ParserConfig{Strict: true}).ReadRequest(
+			strings.NewReader(msg))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: got error %v, want a ParseError", msg, err)
+			continue
+		}
+
+		if parseErr.Line != c.line || parseErr.Offset != offset ||
+			parseErr.Header != c.header {
+			t.Errorf("%q: got line %d, offset %d, header %q, want %d, %d, %q",
+				msg, parseErr.Line, parseErr.Offset, parseErr.Header, c.line,
+				offset, c.header)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	msg := "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP a\r\n" +
+		"Call-ID: a\r\n" +
+		"l: 0\r\n\r\n"
+
+	for _, c := range []struct {
+		config ParserConfig
+		want   LimitError
+	}{
+		{ParserConfig{MaxHeaderCount: 2},
+			LimitError{"header count", 2, StatusMessageTooLarge}},
+		{ParserConfig{MaxStartLineSize: 10},
+			LimitError{"start line size", 10, StatusRequestURITooLong}},
+		{ParserConfig{MaxHeaderSize: 20},
+			LimitError{"header size", 20, StatusMessageTooLarge}},
+	} {
+		_, err := c.config.ReadRequest(strings.NewReader(msg))
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || *limitErr != c.want {
+			t.Errorf("%+v: got error %v, want %+v", c.config, err, c.want)
+		}
+
+		if !errors.Is(err, ErrBadMessage) {
+			t.Errorf("%+v: error %v does not match ErrBadMessage", c.config,
+				err)
+		}
+	}
+
+	if _, err := (&ParserConfig{MaxHeaderCount: 3}).ReadRequest(
+		strings.NewReader(msg)); err != nil {
+		t.Fatalf("unexpected error at the header count limit: %v", err)
+	}
+}
+
+func TestReadStreamMessage(t *testing.T) {
+	// The blank line of the first message ends with a bare LF, which strict
+	// mode rejects without reading the body as header lines.
+	stream := "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"Content-Length: 18\r\n" +
+		"\n" +
+		"Not-A-Header: body" +
+		"OPTIONS sip:carol@example.com SIP/2.0\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	buf := bufio.NewReader(strings.NewReader(stream))
+	config := &ParserConfig{Strict: true}
+
+	if _, err := config.readStreamMessage(buf); !errors.Is(err,
+		ErrBadMessage) {
+		t.Fatalf("got error %v, want ErrBadMessage", err)
+	}
+
+	msg, err := config.readStreamMessage(buf)
+	if req, ok := msg.(*Request); err != nil || !ok || req.URI.User != "carol" {
+		t.Fatalf("got %v, %v, want the second request", msg, err)
+	}
+
+	// An oversized body is not read.
+	stream = "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+		"Content-Length: 99999999\r\n\r\n" +
+		strings.Repeat("x", 100)
+	buf = bufio.NewReader(strings.NewReader(stream))
+	_, err = DefaultParserConfig.readStreamMessage(buf)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) ||
+		limitErr.StatusCode != StatusRequestEntityTooLarge {
+		t.Fatalf("got error %v, want a body size LimitError", err)
+	}
+
+	if buf.Buffered() != 100 {
+		t.Fatalf("%d bytes of the body were read", 100-buf.Buffered())
+	}
+}
@@ -2,8 +2,10 @@ package sipnet
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 )
@@ -12,114 +14,660 @@ import (
 // received failed to be parsed.
 var ErrBadMessage = errors.New("sip: bad message")
 
-// ReadRequest reads a SIP request (i.e. message from a UAC) from a reader.
+// errKeepAlive is returned by readStreamMessage when a CRLF keep-alive
+// ping (RFC 5626 section 3.5.1) is received instead of a message.
+var errKeepAlive = errors.New("sip: keep-alive")
+
+var errLineTooLong = errors.New("sip: line too long")
+
+// LimitError is returned when a message exceeds one of the limits of a
+// ParserConfig. It matches ErrBadMessage with errors.Is.
+type LimitError struct {
+	// Limit is the name of the limit which was exceeded, such as
+	// "start line size" or "body size".
+	Limit string
+	Max   int
+
+	// StatusCode is the status code to respond with, which is one of
+	// StatusRequestURITooLong, StatusMessageTooLarge or
+	// StatusRequestEntityTooLarge.
+	StatusCode int
+}
+
+func (e *LimitError) Error() string {
+	return "sip: " + e.Limit + " exceeds limit of " + strconv.Itoa(e.Max)
+}
+
+// Unwrap returns ErrBadMessage.
+func (e *LimitError) Unwrap() error {
+	return ErrBadMessage
+}
+
+// ParseError is returned when a message fails to be parsed. It matches both
+// ErrBadMessage and ErrParseError with errors.Is.
+type ParseError struct {
+	// Line is the number of the offending line, starting from 1 for the
+	// start line, or 0 if the error is not tied to a line.
+	Line int
+
+	// Header is the name of the offending header, or the first word of an
+	// offending line which has no valid header name. It is empty if the
+	// error is not tied to a header line.
+	Header string
+
+	// Offset is the byte offset of the start of the offending line from the
+	// start of the message.
+	Offset int
+	Cause  string
+
+	// unframed is set when the end of the message cannot be found, so that
+	// a stream can no longer be read from.
+	unframed bool
+}
+
+func (e *ParseError) Error() string {
+	msg := "sip: bad message"
+	if e.Line > 0 {
+		msg += " at line " + strconv.Itoa(e.Line) + " (offset " +
+			strconv.Itoa(e.Offset) + ")"
+	}
+
+	if e.Header != "" {
+		msg += " in " + e.Header + " header"
+	}
+
+	return msg + ": " + e.Cause
+}
+
+// Is reports whether target is ErrBadMessage or ErrParseError.
+func (e *ParseError) Is(target error) bool {
+	return target == ErrBadMessage || target == ErrParseError
+}
+
+// isUnframed reports whether err means that the end of a message on a
+// stream could not be found, so that the stream can no longer be read.
+func isUnframed(err error) bool {
+	var limitErr *LimitError
+	var parseErr *ParseError
+	return errors.As(err, &limitErr) ||
+		(errors.As(err, &parseErr) && parseErr.unframed)
+}
+
+func startLineError(cause string) *ParseError {
+	return &ParseError{Line: 1, Cause: cause}
+}
+
+// lineReader reads the lines of a message, keeping track of the position
+// of the last line read for ParseErrors.
+type lineReader struct {
+	*bufio.Reader
+	line   int
+	offset int
+	next   int
+
+	// lengthLine and lengthOffset are the position of the Content-Length
+	// header.
+	lengthLine   int
+	lengthOffset int
+}
+
+// errorAt returns a *ParseError positioned at the last line read.
+func (rd *lineReader) errorAt(header, cause string) *ParseError {
+	return &ParseError{
+		Line:   rd.line,
+		Header: header,
+		Offset: rd.offset,
+		Cause:  cause,
+	}
+}
+
+// ParserConfig configures the limits and strictness used when reading
+// messages. Limits which are 0 use the value of DefaultParserConfig.
+type ParserConfig struct {
+	// MaxStartLineSize is the maximum size in bytes of the request or status
+	// line. Exceeding it is a StatusRequestURITooLong error.
+	MaxStartLineSize int
+
+	// MaxHeaderCount is the maximum number of header lines, and
+	// MaxHeaderSize is the maximum total size in bytes of the header lines.
+	// Exceeding either is a StatusMessageTooLarge error.
+	MaxHeaderCount int
+	MaxHeaderSize  int
+
+	// MaxBodySize is the maximum size in bytes of a body. Exceeding it is a
+	// StatusRequestEntityTooLarge error.
+	MaxBodySize int
+
+	// Strict rejects messages which do not strictly follow the RFC 3261
+	// grammar. Otherwise, bare LF line endings and extra white space in the
+	// start line are accepted, and malformed header lines are skipped.
+	Strict bool
+}
+
+// DefaultParserConfig is the ParserConfig used by ReadRequest, ReadResponse
+// and listeners without a ParserConfig.
+var DefaultParserConfig = &ParserConfig{
+	MaxStartLineSize: 8 << 10,
+	MaxHeaderCount:   256,
+	MaxHeaderSize:    64 << 10,
+	MaxBodySize:      1 << 20,
+}
+
+func limit(value, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+// ReadRequest reads a SIP request (i.e. message from a UAC) from a reader
+// using DefaultParserConfig.
 func ReadRequest(rd io.Reader) (*Request, error) {
-	buf := bufio.NewReader(rd)
-	line, err := buf.ReadString('\n')
+	return DefaultParserConfig.ReadRequest(rd)
+}
+
+// ReadResponse reads a SIP response (i.e. message from a UAS) from a reader
+// using DefaultParserConfig.
+func ReadResponse(rd io.Reader) (*Response, error) {
+	return DefaultParserConfig.ReadResponse(rd)
+}
+
+// ReadRequest reads a SIP request (i.e. message from a UAC) from a reader.
+// The body is read according to the Content-Length header. If rd is a
+// *bufio.Reader it is read from directly, so that any data buffered after
+// the message can be used to read the next message.
+func (c *ParserConfig) ReadRequest(rd io.Reader) (*Request, error) {
+	msg, err := c.readMessage(bufferedReader(rd), true)
 	if err != nil {
 		return nil, err
 	}
 
-	if line[len(line)-2:] != "\r\n" {
-		return nil, ErrBadMessage
+	req, ok := msg.(*Request)
+	if !ok {
+		return nil, startLineError("expected a request")
 	}
 
-	args := strings.Split(line, " ")
-	if len(args) != 3 {
-		return nil, ErrBadMessage
+	return req, nil
+}
+
+// ReadResponse reads a SIP response (i.e. message from a UAS) from a reader.
+// The body is read according to the Content-Length header. If rd is a
+// *bufio.Reader it is read from directly, so that any data buffered after
+// the message can be used to read the next message.
+func (c *ParserConfig) ReadResponse(rd io.Reader) (*Response, error) {
+	msg, err := c.readMessage(bufferedReader(rd), true)
+	if err != nil {
+		return nil, err
 	}
 
-	r := NewRequest()
-	r.Method = args[0]
-	r.Server = args[1]
-	r.SIPVersion = args[2][:len(args[2])-2]
+	resp, ok := msg.(*Response)
+	if !ok {
+		return nil, startLineError("expected a response")
+	}
+
+	return resp, nil
+}
+
+func bufferedReader(rd io.Reader) *bufio.Reader {
+	if buf, ok := rd.(*bufio.Reader); ok {
+		return buf
+	}
+
+	return bufio.NewReader(rd)
+}
+
+// readDatagram reads a *Request or *Response from a single datagram
+// (i.e. a UDP packet). If the message has no Content-Length, the body
+// extends to the end of the datagram.
+func (c *ParserConfig) readDatagram(data []byte) (interface{}, error) {
+	msg, err := c.readMessage(bufio.NewReader(bytes.NewReader(data)), false)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &ParseError{
+			Offset: len(data),
+			Cause:  "unexpected end of datagram",
+		}
+	}
+
+	return msg, err
+}
+
+// readStreamMessage reads the next *Request or *Response from a stream
+// based connection (i.e. TCP), skipping CRLFs sent between messages. It
+// returns errKeepAlive when a double CRLF keep-alive ping is received.
+//
+// Errors which match ErrBadMessage leave the reader at the start of the
+// next message, except for *LimitErrors and errors of the Content-Length,
+// after which the stream can no longer be framed (see isUnframed). Any
+// other error means the stream can no longer be read from.
+func (c *ParserConfig) readStreamMessage(buf *bufio.Reader) (interface{},
+	error) {
+	crlfs := 0
+	for {
+		peek, err := buf.Peek(2)
+		if err != nil && len(peek) == 0 {
+			return nil, err
+		}
+
+		if string(peek) != "\r\n" {
+			if crlfs > 0 && peek[0] == '\n' {
+				buf.Discard(1)
+				continue
+			}
+			break
+		}
 
-	err = parseHeader(buf, r.Header)
+		buf.Discard(2)
+		crlfs++
+		if crlfs == 2 {
+			return nil, errKeepAlive
+		}
+	}
+
+	return c.readMessage(buf, true)
+}
+
+// readMessage reads a single *Request or *Response from buf. If stream is
+// true the body is framed strictly by the Content-Length header, otherwise
+// a message without a Content-Length has a body which extends to the end
+// of buf.
+//
+// Parse errors are only returned after the whole message (including its
+// body) has been consumed, so that the next message on a stream can still
+// be read.
+func (c *ParserConfig) readMessage(buf *bufio.Reader, stream bool) (interface{},
+	error) {
+	rd := &lineReader{Reader: buf}
+	maxStartLine := limit(c.MaxStartLineSize,
+		DefaultParserConfig.MaxStartLineSize)
+	line, lineErr := c.readLine(rd, maxStartLine)
+	if lineErr == errLineTooLong {
+		return nil, &LimitError{
+			Limit:      "start line size",
+			Max:        maxStartLine,
+			StatusCode: StatusRequestURITooLong,
+		}
+	} else if lineErr != nil && !errors.Is(lineErr, ErrBadMessage) {
+		return nil, lineErr
+	}
+
+	var h Header
+	headerErr := c.parseHeader(rd, &h)
+	if headerErr != nil && !errors.Is(headerErr, ErrBadMessage) {
+		return nil, headerErr
+	}
+
+	var limitErr *LimitError
+	if errors.As(headerErr, &limitErr) {
+		return nil, headerErr
+	}
+
+	body, err := c.readBody(rd, &h, stream)
 	if err != nil {
 		return nil, err
 	}
 
-	length, err := strconv.Atoi(r.Header.Get("Content-Length"))
-	if err != nil {
+	if lineErr != nil {
+		return nil, lineErr
+	}
+
+	if headerErr != nil {
+		return nil, headerErr
+	}
+
+	if strings.HasPrefix(line, "SIP/") {
+		r, err := c.parseStatusLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Header = h
+		r.Body = body
 		return r, nil
 	}
 
-	body := make([]byte, length)
-	_, err = buf.Read(body)
+	r, err := c.parseRequestLine(line)
 	if err != nil {
-		return r, err
+		return nil, err
 	}
 
+	r.Header = h
 	r.Body = body
-
 	return r, nil
 }
 
-// ReadResponse reads a SIP response (i.e. message from a UAS) from a reader.
-func ReadResponse(rd io.Reader) (*Response, error) {
-	buf := bufio.NewReader(rd)
-	line, err := buf.ReadString('\n')
-	if err != nil {
-		return nil, err
+// readLine reads a line of at most max bytes, and returns it without its
+// line ending. Lines must end with a CRLF unless the config is lenient, but
+// a line ending with a bare LF is still returned with the *ParseError, so
+// that the end of the header can be found.
+func (c *ParserConfig) readLine(rd *lineReader, max int) (string, error) {
+	rd.line++
+	rd.offset = rd.next
+
+	var line []byte
+	for {
+		chunk, err := rd.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max+2 {
+			return "", errLineTooLong
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		} else if err != nil {
+			return "", err
+		}
+
+		break
 	}
 
-	if line[len(line)-2:] != "\r\n" {
-		return nil, ErrBadMessage
+	rd.next += len(line)
+	if bytes.HasSuffix(line, []byte("\r\n")) {
+		return string(line[:len(line)-2]), nil
 	}
 
-	args := strings.Split(line, " ")
-	if len(args) < 3 {
-		return nil, ErrBadMessage
+	if c.Strict {
+		return string(line[:len(line)-1]),
+			rd.errorAt("", "line does not end with CRLF")
 	}
 
-	r := NewResponse()
-	r.SIPVersion = args[0]
-	r.StatusCode, err = strconv.Atoi(args[1])
-	if err != nil {
-		return nil, err
+	return string(line[:len(line)-1]), nil
+}
+
+func (c *ParserConfig) parseRequestLine(line string) (*Request, error) {
+	var args []string
+	if c.Strict {
+		args = strings.Split(line, " ")
+	} else {
+		args = strings.FieldsFunc(line, isLWS)
 	}
 
-	r.Status = StatusText(r.StatusCode)
+	if len(args) != 3 {
+		return nil, startLineError("malformed request line")
+	}
 
-	err = parseHeader(buf, r.Header)
-	if err != nil {
-		return nil, err
+	if !isToken(args[0]) {
+		return nil, startLineError("invalid method")
 	}
 
-	length, err := strconv.Atoi(r.Header.Get("Content-Length"))
-	if err != nil {
-		return r, nil
+	if c.Strict && !isSIPVersion(args[2]) {
+		return nil, startLineError("invalid SIP version")
 	}
 
-	body := make([]byte, length)
-	_, err = buf.Read(body)
+	uri, err := ParseURI(args[1])
 	if err != nil {
-		return r, err
+		return nil, startLineError("invalid Request-URI")
 	}
 
-	r.Body = body
+	r := NewRequest()
+	r.Method = args[0]
+	r.URI = uri
+	r.SIPVersion = args[2]
+	return r, nil
+}
+
+func (c *ParserConfig) parseStatusLine(line string) (*Response, error) {
+	var version, code, reason string
+	if c.Strict {
+		args := strings.SplitN(line, " ", 3)
+		if len(args) < 3 {
+			return nil, startLineError("malformed status line")
+		}
+
+		if !isSIPVersion(args[0]) {
+			return nil, startLineError("invalid SIP version")
+		}
+
+		if len(args[1]) != 3 {
+			return nil, startLineError("invalid status code")
+		}
+
+		version, code, reason = args[0], args[1], args[2]
+	} else {
+		fields := strings.FieldsFunc(line, isLWS)
+		if len(fields) < 2 {
+			return nil, startLineError("malformed status line")
+		}
+
+		version, code = fields[0], fields[1]
+		rest := strings.TrimLeftFunc(line, isLWS)[len(version):]
+		rest = strings.TrimLeftFunc(rest, isLWS)[len(code):]
+		reason = strings.TrimFunc(rest, isLWS)
+	}
+
+	r := NewResponse()
+	r.SIPVersion = version
+	r.Status = reason
+
+	var err error
+	r.StatusCode, err = strconv.Atoi(code)
+	if err != nil || r.StatusCode < 100 || r.StatusCode > 699 {
+		return nil, startLineError("invalid status code")
+	}
 
 	return r, nil
 }
 
-func parseHeader(buf *bufio.Reader, h Header) error {
+// isLWS reports whether r is linear white space, which separates the
+// elements of a start line.
+func isLWS(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// isSIPVersion reports whether str is a valid SIP-Version, such as
+// "SIP/2.0".
+func isSIPVersion(str string) bool {
+	if len(str) < 4 || !strings.EqualFold(str[:4], "SIP/") {
+		return false
+	}
+
+	dot := strings.IndexByte(str, '.')
+	if dot < 0 {
+		return false
+	}
+
+	major, minor := str[4:dot], str[dot+1:]
+	return major != "" && minor != "" &&
+		strings.Trim(major, "0123456789") == "" &&
+		strings.Trim(minor, "0123456789") == ""
+}
+
+// parseHeader reads header lines into h until an empty line, unfolding
+// lines which continue the previous line with leading white space. If
+// a line is malformed, the rest of the header is still read and a
+// *ParseError for the first malformed line is returned.
+func (c *ParserConfig) parseHeader(rd *lineReader, h *Header) error {
+	maxCount := limit(c.MaxHeaderCount, DefaultParserConfig.MaxHeaderCount)
+	maxSize := limit(c.MaxHeaderSize, DefaultParserConfig.MaxHeaderSize)
+
+	var result error
+	fail := func(err error) {
+		if result == nil {
+			result = err
+		}
+	}
+
+	var key, value string
+	size := 0
+	count := 0
+
 	for {
-		line, err := buf.ReadString('\n')
-		if err != nil {
+		line, err := c.readLine(rd, maxSize-size)
+		var lineErr *ParseError
+		if err == errLineTooLong {
+			return &LimitError{
+				Limit:      "header size",
+				Max:        maxSize,
+				StatusCode: StatusMessageTooLarge,
+			}
+		} else if errors.Is(err, ErrBadMessage) {
+			// The line is still used, as a blank line ends the header
+			// even if it ends with a bare LF. The header of the line is
+			// set once it is known.
+			errors.As(err, &lineErr)
+			fail(err)
+		} else if err != nil {
 			return err
 		}
 
-		if line == "\r\n" {
-			return nil
+		size += len(line) + 2
+
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			if key == "" {
+				if lineErr != nil {
+					lineErr.Header = lineHeader(line)
+				}
+				if c.Strict {
+					fail(rd.errorAt(lineHeader(line),
+						"continuation line without a header"))
+				}
+				continue
+			}
+
+			if lineErr != nil {
+				lineErr.Header = CanonicalHeaderKey(key)
+			}
+			value += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		if key != "" {
+			h.appendRaw(key, value)
+			key = ""
+		}
+
+		if line == "" {
+			return result
+		}
+
+		if lineErr != nil {
+			lineErr.Header = lineHeader(line)
+		}
+
+		count++
+		if count > maxCount {
+			return &LimitError{
+				Limit:      "header count",
+				Max:        maxCount,
+				StatusCode: StatusMessageTooLarge,
+			}
 		}
 
 		keyPosition := strings.Index(line, ":")
 		if keyPosition == -1 {
-			return ErrBadMessage
+			if c.Strict {
+				fail(rd.errorAt(lineHeader(line), "missing colon"))
+			}
+			continue
+		}
+
+		name := strings.TrimRight(line[:keyPosition], " \t")
+		if !isToken(name) {
+			if c.Strict {
+				fail(rd.errorAt(lineHeader(line), "invalid header name"))
+			}
+			continue
+		}
+
+		if rd.lengthLine == 0 && CanonicalHeaderKey(name) == "Content-Length" {
+			rd.lengthLine = rd.line
+			rd.lengthOffset = rd.offset
+		}
+
+		key = name
+		value = strings.TrimSpace(line[keyPosition+1:])
+	}
+}
+
+// lineHeader returns the name of the header of a header line for
+// ParseErrors, which is the text before its colon in its canonical form if
+// it is valid, or the first word of the line if it has no colon.
+func lineHeader(line string) string {
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		if fields := strings.FieldsFunc(line, isLWS); len(fields) > 0 {
+			return fields[0]
+		}
+		return ""
+	}
+
+	name := strings.TrimSpace(line[:colon])
+	if isToken(name) {
+		return CanonicalHeaderKey(name)
+	}
+
+	return name
+}
+
+// readBody reads the body of a message according to its Content-Length.
+func (c *ParserConfig) readBody(rd *lineReader, h *Header,
+	stream bool) ([]byte, error) {
+	maxSize := limit(c.MaxBodySize, DefaultParserConfig.MaxBodySize)
+	limitErr := &LimitError{
+		Limit:      "body size",
+		Max:        maxSize,
+		StatusCode: StatusRequestEntityTooLarge,
+	}
+
+	values := h.Values("Content-Length")
+	if len(values) == 0 {
+		if stream {
+			return nil, nil
 		}
 
-		key := normalizeKey(strings.TrimSpace(line[:keyPosition]))
-		value := strings.TrimSpace(line[keyPosition+1:])
-		h.Set(key, value)
+		body, err := ioutil.ReadAll(io.LimitReader(rd, int64(maxSize)+1))
+		if len(body) > maxSize {
+			return nil, limitErr
+		} else if len(body) == 0 {
+			return nil, err
+		}
+
+		return body, err
+	}
+
+	lengthErr := func(cause string) *ParseError {
+		return &ParseError{
+			Line:     rd.lengthLine,
+			Header:   "Content-Length",
+			Offset:   rd.lengthOffset,
+			Cause:    cause,
+			unframed: stream,
+		}
 	}
+
+	length := -1
+	for _, value := range values {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return nil, lengthErr("invalid length")
+		}
+
+		// Repeated values are tolerated as long as they agree, as the body
+		// cannot be found otherwise (RFC 4475 section 3.3.9).
+		if length >= 0 && n != length {
+			return nil, lengthErr("conflicting lengths")
+		}
+
+		length = n
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	if length > maxSize {
+		// The body is not discarded, as the length is chosen by the sender.
+		// A stream can no longer be framed after this error.
+		return nil, limitErr
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(rd, body)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return body, err
 }
@@ -1,9 +1,8 @@
 package sipnet
 
 import (
-	"bytes"
-	"net"
-	"strconv"
+	"context"
+	"io"
 )
 
 // SIPVersion is the version of SIP used by this library.
@@ -18,22 +17,62 @@ const (
 	MethodRegister = "REGISTER"
 	MethodOptions  = "OPTIONS"
 	MethodInfo     = "INFO"
+	MethodPrack    = "PRACK"
+	MethodUpdate   = "UPDATE"
+	MethodMessage  = "MESSAGE"
+	MethodPublish  = "PUBLISH"
+
+	MethodSubscribe = "SUBSCRIBE"
+	MethodNotify    = "NOTIFY"
+	MethodRefer     = "REFER"
 )
 
 // Request represents a SIP request (i.e. a message sent by a UAC to a UAS).
 type Request struct {
 	Method     string
-	Server     string
+	URI        URI
 	SIPVersion string
 	Header     Header
 	Body       []byte
+
+	// CompactHeaders causes header field names to be written using their
+	// compact forms where one exists, to save space on UDP.
+	CompactHeaders bool
+
+	ctx context.Context
+
+	// toTag is the tag added to the To header of responses to the request,
+	// see NewResponseFor.
+	toTag string
+}
+
+// Context returns the context of the request. For requests served by a
+// Server, it is cancelled when the request's transaction ends (see
+// Server), and it is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of the request with its context
+// changed to ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("sipnet: nil context")
+	}
+
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 // NewRequest returns a new request.
 func NewRequest() *Request {
 	return &Request{
 		SIPVersion: SIPVersion,
-		Header:     make(Header),
 	}
 }
 
@@ -43,26 +82,18 @@ type Flushable interface {
 	Flush() error
 }
 
-// WriteTo writes the request data to a Conn. It automatically adds a
-// a Content-Length to the header, calls Flush() on the Conn.
-func (r *Request) WriteTo(conn net.Conn) error {
-	buf := new(bytes.Buffer)
-
-	buf.Write([]byte(r.Method + " " + r.Server + " " + SIPVersion + "\r\n"))
-
-	r.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
-
-	r.Header.WriteTo(buf)
-	buf.Write(r.Body)
-
-	_, err := conn.Write(buf.Bytes())
+// WriteTo writes the request data to a writer, such as a net.Conn or a
+// *Conn. It writes a Content-Length matching the body, and calls Flush() on
+// the writer if it is Flushable. The request is not modified.
+func (r *Request) WriteTo(conn io.Writer) (int64, error) {
+	n, err := r.AppendTo(conn)
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	if flushConn, ok := conn.(Flushable); ok {
-		return flushConn.Flush()
+		return n, flushConn.Flush()
 	}
 
-	return nil
+	return n, nil
 }
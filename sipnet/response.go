@@ -1,70 +1,227 @@
 package sipnet
 
-import (
-	"strconv"
-	"strings"
-)
+import "sync"
 
 // Response represents a SIP response (i.e. a message sent by a UAS to a UAC).
 type Response struct {
 	StatusCode int
+
+	// Status is the reason phrase of the response. Responses read from a
+	// connection keep the reason phrase they were received with. If empty,
+	// StatusText(StatusCode) is written instead.
 	Status     string
 	SIPVersion string
 	Header     Header
 	Body       []byte
+
+	// CompactHeaders causes header field names to be written using their
+	// compact forms where one exists, to save space on UDP.
+	CompactHeaders bool
 }
 
 // NewResponse returns a new response.
 func NewResponse() *Response {
 	return &Response{
 		SIPVersion: SIPVersion,
-		Header:     make(Header),
 	}
 }
 
+// NewResponseFor returns a response to a request as described by RFC 3261
+// section 8.2.6. It copies the Via headers in order, From, To, Call-ID and
+// CSeq, and Record-Route for responses which create a dialog. If the To
+// header has no tag, a random tag is added (except to 100 Trying responses,
+// which instead copy Timestamp). The tag is generated once per request, or
+// per server transaction for requests received by a Listener, so that every
+// response to the request has the same tag. No tag is added if the system's
+// random number generator fails. If reason is empty, StatusText(code) is
+// used as the reason phrase.
+func NewResponseFor(req *Request, code int, reason string) *Response {
+	r := NewResponse()
+	r.StatusCode = code
+	r.Status = reason
+
+	for _, key := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+		for _, value := range req.Header.Values(key) {
+			r.Header.Add(key, value)
+		}
+	}
+
+	if code == StatusTrying {
+		if timestamp, found := req.Header.First("Timestamp"); found {
+			r.Header.Set("Timestamp", timestamp)
+		}
+	} else if to, err := ParseUser(req.Header.Get("To")); err == nil &&
+		!to.Arguments.Has("tag") {
+		if tag := req.localTag(); tag != "" {
+			to.Arguments.Set("tag", tag)
+			r.Header.Set("To", to.String())
+		}
+	}
+
+	if code > StatusTrying && code < 300 && isDialogCreating(req.Method) {
+		for _, value := range req.Header.Values("Record-Route") {
+			r.Header.Add("Record-Route", value)
+		}
+	}
+
+	return r
+}
+
+// localTag returns the tag a UAS adds to the To header of its responses to
+// the request, generating it on first use. RFC 3261 section 19.3 requires
+// tags to be globally unique and random, so that UASs which receive the
+// same forked request pick different tags. It returns an empty string if
+// the tag cannot be generated.
+//
+// Responses to a request may be built concurrently, such as by its handler
+// and by its server transaction, so the tag is generated under
+// localTagMutex for every response to see the same one.
+func (r *Request) localTag() string {
+	localTagMutex.Lock()
+	defer localTagMutex.Unlock()
+
+	if r.toTag == "" {
+		r.toTag, _ = randomToken(8)
+	}
+
+	return r.toTag
+}
+
+// localTagMutex guards the toTag of requests. It is not a field of Request,
+// as requests are copied by value.
+var localTagMutex sync.Mutex
+
+// isDialogCreating reports whether a request with the method creates a
+// dialog when it receives a 1xx (other than 100) or 2xx response.
+func isDialogCreating(method string) bool {
+	switch method {
+	case MethodInvite, MethodSubscribe, MethodRefer:
+		return true
+	}
+
+	return false
+}
+
 // WriteTo writes the response data to a Conn. It automatically adds a
-// a Content-Length, CSeq, Call-ID and Via header. It also sets the Status message
-// appropriately and automatically calls Flush() on the Conn.
+// a Content-Length, CSeq, Call-ID and all of the request's Via headers, with
+// received and rport parameters added to the top Via as needed. If the
+// request has a server transaction, the response is sent in it, so that it
+// is retransmitted as needed. The headers are added to a copy of the
+// response, so r is not modified.
 func (r *Response) WriteTo(conn *Conn, req *Request) error {
-	_, err := conn.Write([]byte(SIPVersion + " " + strconv.Itoa(r.StatusCode) +
-		" " + StatusText(r.StatusCode) + "\r\n"))
+	resp, err := r.withRequest(conn, req)
 	if err != nil {
 		return err
 	}
 
-	r.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
-	reqVia, err := ParseVia(req.Header.Get("Via"))
-	if err != nil {
-		return err
+	if tx := conn.ServerTransaction(req); tx != nil {
+		return tx.Respond(resp)
 	}
 
-	ipPort := strings.Split(conn.Addr().String(), ":")
-	reqVia.Arguments.Set("received", ipPort[0])
-	reqVia.Arguments.Set("rport", ipPort[1])
-	r.Header.Set("Via", reqVia.String())
-	r.Header.Set("CSeq", req.Header.Get("CSeq"))
-	r.Header.Set("Call-ID", req.Header.Get("Call-ID"))
+	return conn.send(resp.Marshal())
+}
 
-	_, err = r.Header.WriteTo(conn)
+// withRequest returns a copy of the response with the Via, CSeq and Call-ID
+// headers of the request it responds to.
+func (r *Response) withRequest(conn *Conn, req *Request) (*Response, error) {
+	vias, err := ParseViaStack(&req.Header)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if len(vias) == 0 {
+		return nil, ErrParseError
 	}
 
-	conn.Write(r.Body)
-	return conn.Flush()
+	resp := *r
+	resp.Header = r.Header.Clone()
+	vias[0].SetReceived(conn.Addr())
+	vias.SetHeader(&resp.Header)
+	resp.Header.Set("CSeq", req.Header.Get("CSeq"))
+	resp.Header.Set("Call-ID", req.Header.Get("Call-ID"))
+	return &resp, nil
 }
 
-// BadRequest responds to a Conn with a StatusBadRequest for convenience.
+// reasonPhrase returns the reason phrase to write for the response.
+func (r *Response) reasonPhrase() string {
+	if r.Status != "" {
+		return r.Status
+	}
+
+	return StatusText(r.StatusCode)
+}
+
+// BadRequest responds to a Conn with a StatusBadRequest for convenience,
+// using reason as the reason phrase.
 func (r *Response) BadRequest(conn *Conn, req *Request, reason string) {
-	r.StatusCode = StatusBadRequest
-	r.Header.Set("Reason-Phrase", reason)
-	r.WriteTo(conn, req)
+	r.respond(conn, req, StatusBadRequest, reason)
 }
 
 // ServerError responds to a Conn with a StatusServerInternalError
-// for convenience.
+// for convenience, using reason as the reason phrase.
 func (r *Response) ServerError(conn *Conn, req *Request, reason string) {
-	r.StatusCode = StatusServerInternalError
-	r.Header.Set("Reason-Phrase", reason)
+	r.respond(conn, req, StatusServerInternalError, reason)
+}
+
+// respond writes the response to a Conn with a status code and reason,
+// adding the From and To headers of NewResponseFor if they are missing.
+func (r *Response) respond(conn *Conn, req *Request, code int,
+	reason string) {
+	r.StatusCode = code
+	r.Status = reason
+
+	base := NewResponseFor(req, code, reason)
+	for _, key := range []string{"From", "To"} {
+		if _, found := r.Header.First(key); found {
+			continue
+		}
+
+		for _, value := range base.Header.Values(key) {
+			r.Header.Add(key, value)
+		}
+	}
+
 	r.WriteTo(conn, req)
 }
+
+// IsProvisional returns whether or not the response is a provisional (1xx)
+// response.
+func (r *Response) IsProvisional() bool {
+	return r.StatusCode >= 100 && r.StatusCode < 200
+}
+
+// IsFinal returns whether or not the response is a final (2xx to 6xx)
+// response.
+func (r *Response) IsFinal() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 700
+}
+
+// IsSuccess returns whether or not the response is a success (2xx)
+// response.
+func (r *Response) IsSuccess() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// IsRedirect returns whether or not the response is a redirection (3xx)
+// response.
+func (r *Response) IsRedirect() bool {
+	return r.StatusCode >= 300 && r.StatusCode < 400
+}
+
+// IsClientError returns whether or not the response is a client error (4xx)
+// response.
+func (r *Response) IsClientError() bool {
+	return r.StatusCode >= 400 && r.StatusCode < 500
+}
+
+// IsServerError returns whether or not the response is a server error (5xx)
+// response.
+func (r *Response) IsServerError() bool {
+	return r.StatusCode >= 500 && r.StatusCode < 600
+}
+
+// IsGlobalFailure returns whether or not the response is a global failure
+// (6xx) response.
+func (r *Response) IsGlobalFailure() bool {
+	return r.StatusCode >= 600 && r.StatusCode < 700
+}
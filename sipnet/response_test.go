@@ -0,0 +1,125 @@
+package sipnet
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewResponseForTag(t *testing.T) {
+	req := testRequest(MethodInvite)
+
+	// Responses built concurrently, such as by a handler and by the
+	// transaction, share the tag.
+	tags := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range tags {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := NewResponseFor(req, StatusRinging, "")
+			to, err := ParseUser(resp.Header.Get("To"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			tags[i] = to.Arguments.Get("tag")
+		}(i)
+	}
+	wg.Wait()
+
+	for _, tag := range tags {
+		if tag == "" || tag != tags[0] {
+			t.Fatalf("got tags %q, want one tag", tags)
+		}
+	}
+}
+
+func TestResponseStatusClass(t *testing.T) {
+	for _, c := range []struct {
+		code  int
+		class int
+	}{
+		{0, 0},
+		{99, 0},
+		{100, 1},
+		{199, 1},
+		{200, 2},
+		{299, 2},
+		{300, 3},
+		{399, 3},
+		{400, 4},
+		{499, 4},
+		{500, 5},
+		{599, 5},
+		{600, 6},
+		{699, 6},
+		{700, 0},
+	} {
+		r := &Response{StatusCode: c.code}
+		got := []bool{r.IsProvisional(), r.IsSuccess(), r.IsRedirect(),
+			r.IsClientError(), r.IsServerError(), r.IsGlobalFailure()}
+		for i, is := range got {
+			if is != (c.class == i+1) {
+				t.Errorf("%d: got class %d is %v", c.code, i+1, is)
+			}
+		}
+
+		if final := c.class >= 2; r.IsFinal() != final {
+			t.Errorf("%d: got IsFinal %v, want %v", c.code, !final, final)
+		}
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	for _, c := range []struct {
+		code int
+		text string
+	}{
+		{StatusTrying, "Trying"},
+		{StatusEarlyDialogTerminated, "Early Dialog Terminated"},
+		{StatusOK, "OK"},
+		{StatusNoNotification, "No Notification"},
+		{StatusAlternativeService, "Alternative Service"},
+		{StatusRequestURITooLong, "Request-URI Too Long"},
+		{StatusUnknownResourcePriority, "Unknown Resource-Priority"},
+		{StatusProvideReferrerIdentity, "Provide Referrer Identity"},
+		{StatusCallTransactionDoesNotExist, "Call/Transaction Does Not Exist"},
+		{StatusSecurityAgreementRequired, "Security Agreement Required"},
+		{StatusServerTimeout, "Server Time-out"},
+		{StatusPushNotificationNotSupported,
+			"Push Notification Service Not Supported"},
+		{StatusPreconditionFailure, "Precondition Failure"},
+		{StatusUnacceptable, "Not Acceptable"},
+		{StatusRejected, "Rejected"},
+		{0, ""},
+		{201, ""},
+		{299, ""},
+		{499, ""},
+		{699, ""},
+		{700, ""},
+	} {
+		if got := StatusText(c.code); got != c.text {
+			t.Errorf("%d: got %q, want %q", c.code, got, c.text)
+		}
+	}
+
+	for code, text := range statusTexts {
+		if code < 100 || code > 699 || text == "" {
+			t.Errorf("%d: invalid registered status %q", code, text)
+		}
+	}
+
+	// The reason phrase of an unregistered code is empty.
+	for code, want := range map[int]string{
+		StatusRinging: "SIP/2.0 180 Ringing\r\n",
+		499:           "SIP/2.0 499 \r\n",
+	} {
+		r := NewResponse()
+		r.StatusCode = code
+		if got := string(r.Marshal()); !strings.HasPrefix(got, want) {
+			t.Errorf("%d: got %q, want prefix %q", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package sipnet
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// A Handler responds to a SIP request.
+//
+// ServeSIP is called in its own goroutine for every request received by a
+// Server, other than retransmissions which are absorbed by the request's
+// server transaction. ACK requests have no transaction and cannot be
+// responded to.
+type Handler interface {
+	ServeSIP(w ResponseWriter, req *Request)
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers.
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// ServeSIP calls f(w, req).
+func (f HandlerFunc) ServeSIP(w ResponseWriter, req *Request) {
+	f(w, req)
+}
+
+// ResponseWriter is used by a Handler to respond to a request within its
+// server transaction.
+type ResponseWriter interface {
+	// Conn returns the connection the request was received on.
+	Conn() *Conn
+
+	// Transaction returns the server transaction of the request, or nil
+	// for ACK requests.
+	Transaction() *ServerTransaction
+
+	// Respond sends a response to the request, which should be built with
+	// NewResponseFor. The Via, CSeq and Call-ID headers of the request are
+	// added as with Response.WriteTo.
+	Respond(resp *Response) error
+
+	// WriteStatus responds to the request with a response built by
+	// NewResponseFor with a status code and reason phrase.
+	WriteStatus(code int, reason string) error
+}
+
+type responseWriter struct {
+	conn *Conn
+	req  *Request
+	tx   *ServerTransaction
+}
+
+// NewResponseWriter returns a ResponseWriter for a request received on a
+// connection, which responds in the request's server transaction.
+func NewResponseWriter(conn *Conn, req *Request) ResponseWriter {
+	return &responseWriter{
+		conn: conn,
+		req:  req,
+		tx:   conn.ServerTransaction(req),
+	}
+}
+
+func (w *responseWriter) Conn() *Conn {
+	return w.conn
+}
+
+func (w *responseWriter) Transaction() *ServerTransaction {
+	return w.tx
+}
+
+func (w *responseWriter) Respond(resp *Response) error {
+	prepared, err := resp.withRequest(w.conn, w.req)
+	if err != nil {
+		return err
+	}
+
+	if w.tx != nil {
+		return w.tx.Respond(prepared)
+	}
+
+	return w.conn.send(prepared.Marshal())
+}
+
+func (w *responseWriter) WriteStatus(code int, reason string) error {
+	return w.Respond(NewResponseFor(w.req, code, reason))
+}
+
+// ServeMux is a request multiplexer which calls the handler registered for
+// the method of a request. Requests with a method which has no handler are
+// responded to with a 405 Method Not Allowed, with an Allow header listing
+// the methods which have handlers.
+type ServeMux struct {
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServeMux returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for a method, replacing any previous
+// handler. Methods are case-sensitive.
+func (m *ServeMux) Handle(method string, handler Handler) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[string]Handler)
+	}
+
+	m.handlers[method] = handler
+}
+
+// HandleFunc registers the handler function for a method.
+func (m *ServeMux) HandleFunc(method string,
+	handler func(w ResponseWriter, req *Request)) {
+	m.Handle(method, HandlerFunc(handler))
+}
+
+// Handler returns the handler registered for a method, or nil.
+func (m *ServeMux) Handler(method string) Handler {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.handlers[method]
+}
+
+// Methods returns the sorted methods which have handlers.
+func (m *ServeMux) Methods() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	methods := make([]string, 0, len(m.handlers))
+	for method := range m.handlers {
+		methods = append(methods, method)
+	}
+
+	sort.Strings(methods)
+	return methods
+}
+
+// ServeSIP dispatches the request to the handler registered for its
+// method. ACK requests without a handler are ignored.
+func (m *ServeMux) ServeSIP(w ResponseWriter, req *Request) {
+	if handler := m.Handler(req.Method); handler != nil {
+		handler.ServeSIP(w, req)
+		return
+	}
+
+	if req.Method == MethodAck {
+		return
+	}
+
+	resp := NewResponseFor(req, StatusMethodNotAllowed, "")
+	resp.Header.Set("Allow", FormatTokenList(m.Methods()))
+	w.Respond(resp)
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown.
+var ErrServerClosed = errors.New("sip: server closed")
+
+// Server accepts requests from a Listener and serves each of them with a
+// Handler in its own goroutine.
+//
+// The context of each request is cancelled when its connection is closed,
+// when Shutdown gives up waiting for handlers, and when its server
+// transaction terminates, such as when a non-INVITE request is not
+// responded to within 64*T1. An INVITE answered with a 2xx response
+// creates a dialog which outlives its transaction, so its context is not
+// cancelled when the transaction terminates afterwards. Handlers of
+// INVITEs should bound the call with Dialog.Context.
+//
+// A request which is left without a final response when its handler
+// returns is responded to with a 500 Server Internal Error, so that the
+// client does not retransmit it until it times out. Handlers must
+// therefore respond before they return.
+type Server struct {
+	// Addr is the address (IP:port) ListenAndServe listens on.
+	Addr string
+
+	// Handler serves the requests. If nil, every request is responded to
+	// with a 405 Method Not Allowed.
+	Handler Handler
+
+	mutex     sync.Mutex
+	listeners map[*Listener]struct{}
+	handlers  sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	shutdown  bool
+}
+
+// ListenAndServe listens on the server's Addr on both TCP and UDP, and
+// serves the requests received.
+func (s *Server) ListenAndServe() error {
+	l, err := Listen(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve accepts requests from a listener and serves them until the
+// listener fails, or ErrServerClosed after Shutdown. Errors reading from a
+// single connection, such as malformed messages or the connection being
+// closed, do not stop the server.
+func (s *Server) Serve(l *Listener) error {
+	handler := s.Handler
+	if handler == nil {
+		handler = NewServeMux()
+	}
+
+	if !s.track(l) {
+		return ErrServerClosed
+	}
+
+	for {
+		req, conn, err := l.AcceptRequest()
+		if err != nil {
+			if conn != nil {
+				continue
+			}
+
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		s.mutex.Lock()
+		if s.shutdown {
+			s.mutex.Unlock()
+			return ErrServerClosed
+		}
+		s.handlers.Add(1)
+		s.mutex.Unlock()
+
+		go s.serve(handler, conn, req)
+	}
+}
+
+// track adds a listener to the server, so that it is closed by Shutdown.
+// It returns false if the server is shut down.
+func (s *Server) track(l *Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[*Listener]struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) isShutdown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shutdown
+}
+
+// serve serves a request with a context which is cancelled as described
+// by Server.
+func (s *Server) serve(handler Handler, conn *Conn, req *Request) {
+	defer s.handlers.Done()
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	w := NewResponseWriter(conn, req)
+	go func() {
+		var txDone <-chan struct{}
+		if tx := w.Transaction(); tx != nil {
+			txDone = tx.Done()
+		}
+
+		for {
+			select {
+			case <-txDone:
+				if !w.Transaction().accepted() {
+					cancel()
+					return
+				}
+				txDone = nil
+			case <-conn.Done():
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	handler.ServeSIP(w, req.WithContext(ctx))
+
+	if tx := w.Transaction(); tx != nil && !tx.answered() {
+		w.WriteStatus(StatusServerInternalError, "")
+	}
+}
+
+// Shutdown stops the server from accepting requests by closing its
+// listeners, and then waits for all of the handlers to return. If ctx is
+// done first, the contexts of the remaining handlers are cancelled and the
+// context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shutdown = true
+	var err error
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	cancel := s.cancel
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if cancel != nil {
+		cancel()
+	}
+
+	return err
+}
@@ -0,0 +1,136 @@
+package sipnet
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	l, peer := newTestPeer(t)
+
+	mux := NewServeMux()
+	mux.HandleFunc(MethodOptions, func(w ResponseWriter, req *Request) {
+		w.WriteStatus(StatusOK, "")
+	})
+	mux.HandleFunc(MethodBye, func(w ResponseWriter, req *Request) {
+		w.WriteStatus(StatusOK, "")
+	})
+	mux.HandleFunc(MethodInvite, func(w ResponseWriter, req *Request) {})
+
+	go (&Server{Handler: mux}).Serve(l)
+
+	peer.WriteTo(testRequest(MethodOptions).Marshal(), l.udpListener.LocalAddr())
+	if resp := readPeer(t, peer).(*Response); resp.StatusCode != StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+
+	peer.WriteTo(testRequest(MethodMessage).Marshal(), l.udpListener.LocalAddr())
+	resp := readPeer(t, peer).(*Response)
+	allow, err := ParseTokenList(&resp.Header, "Allow")
+	if resp.StatusCode != StatusMethodNotAllowed || err != nil ||
+		FormatTokenList(allow) != "BYE, INVITE, OPTIONS" {
+		t.Fatalf("got %q, want 405 with Allow", resp.Marshal())
+	}
+
+	// A request the handler did not respond to gets a 500.
+	peer.WriteTo(testRequest(MethodInvite).Marshal(), l.udpListener.LocalAddr())
+	for {
+		resp := readPeer(t, peer).(*Response)
+		if resp.StatusCode == StatusTrying {
+			continue
+		} else if resp.StatusCode != StatusServerInternalError {
+			t.Fatalf("got %d, want 500", resp.StatusCode)
+		}
+		break
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	l, peer := newTestPeer(t)
+
+	started := make(chan context.Context, 1)
+	release := make(chan struct{})
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		started <- req.Context()
+		<-release
+	})}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	peer.WriteTo(testRequest(MethodInvite).Marshal(), l.udpListener.LocalAddr())
+	ctx := <-started
+
+	// The handler ignores its context, so Shutdown gives up waiting.
+	timeout, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(timeout); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+	}
+
+	// Closing the listener closed the connection, which cancelled the
+	// handler's context.
+	select {
+	case <-ctx.Done():
+	case <-time.After(testWait):
+		t.Fatal("handler context was not cancelled")
+	}
+
+	close(release)
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("handler did not return: %v", err)
+	}
+}
+
+func TestAcceptRequestContext(t *testing.T) {
+	l, _ := newTestPeer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	_, _, err := l.AcceptRequestContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+
+	conn := l.getUDPConnFromPool(l.udpListener.LocalAddr())
+	if err := conn.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// Closing a connection from several goroutines must not panic.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	if err := conn.ReadContext(context.Background()); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, _, err := l.AcceptRequest()
+		accepted <- err
+	}()
+
+	l.Close()
+	if err := <-accepted; err != ErrClosed {
+		t.Fatalf("got error %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,229 @@
+package sipnet
+
+import (
+	"sort"
+	"strings"
+)
+
+// TelURI represents a tel URI as defined by RFC 3966, such as
+// "tel:+1-555-123-4567;ext=22".
+type TelURI struct {
+	// Number is the telephone number with its visual separators removed.
+	// Global numbers start with a "+".
+	Number string
+
+	// PhoneContext is required for local numbers, and is either a domain
+	// name or a global number prefix.
+	PhoneContext   string
+	Extension      string
+	ISDNSubaddress string
+
+	// Params holds any other parameters of the URI.
+	Params HeaderArgs
+}
+
+// ParseTelURI parses a tel URI (including its "tel:" scheme) into a TelURI.
+func ParseTelURI(str string) (TelURI, error) {
+	if len(str) < 4 || !strings.EqualFold(str[:4], "tel:") {
+		return TelURI{}, ErrParseError
+	}
+
+	parts := strings.Split(str[4:], ";")
+	t := TelURI{Number: stripVisualSeparators(parts[0])}
+
+	if t.IsGlobal() {
+		if !isGlobalNumber(parts[0]) {
+			return TelURI{}, ErrParseError
+		}
+	} else if !isLocalNumber(parts[0]) {
+		return TelURI{}, ErrParseError
+	}
+
+	for _, param := range parts[1:] {
+		key := param
+		value := ""
+		if eq := strings.IndexByte(param, '='); eq >= 0 {
+			key = param[:eq]
+			value = param[eq+1:]
+		}
+
+		if !isToken(key) {
+			return TelURI{}, ErrParseError
+		}
+
+		switch strings.ToLower(key) {
+		case "phone-context":
+			if isGlobalNumber(value) {
+				t.PhoneContext = stripVisualSeparators(value)
+			} else if isHostname(value) {
+				t.PhoneContext = value
+			} else {
+				return TelURI{}, ErrParseError
+			}
+		case "ext":
+			if value == "" || !validPhoneDigits(value, isDigit) {
+				return TelURI{}, ErrParseError
+			}
+			t.Extension = stripVisualSeparators(value)
+		case "isub":
+			if value == "" || !validEscaped(value, isURIChar) {
+				return TelURI{}, ErrParseError
+			}
+			t.ISDNSubaddress = value
+		default:
+			if !validEscaped(value, isParamChar) {
+				return TelURI{}, ErrParseError
+			}
+			t.Params = append(t.Params, HeaderArg{Key: key, Value: value})
+		}
+	}
+
+	if !t.IsGlobal() && t.PhoneContext == "" {
+		return TelURI{}, ErrParseError
+	}
+
+	return t, nil
+}
+
+// IsGlobal returns whether or not the number is a global number (i.e. it
+// starts with a "+" and the country code).
+func (t TelURI) IsGlobal() bool {
+	return strings.HasPrefix(t.Number, "+")
+}
+
+// Subscriber returns the text representation of the URI without its
+// "tel:" scheme, which is the telephone-subscriber of RFC 3966.
+func (t TelURI) Subscriber() string {
+	result := t.Number
+	if t.Extension != "" {
+		result += ";ext=" + t.Extension
+	}
+
+	if t.ISDNSubaddress != "" {
+		result += ";isub=" + t.ISDNSubaddress
+	}
+
+	if t.PhoneContext != "" {
+		result += ";phone-context=" + t.PhoneContext
+	}
+
+	for _, param := range t.Params {
+		result += ";" + param.Key
+		if param.Value != "" {
+			result += "=" + param.Value
+		}
+	}
+
+	return result
+}
+
+// String returns the text representation of the tel URI.
+func (t TelURI) String() string {
+	return "tel:" + t.Subscriber()
+}
+
+// URI returns the tel URI as a URI.
+func (t TelURI) URI() URI {
+	return URI{Scheme: "tel", Opaque: t.Subscriber()}
+}
+
+// SIPURI converts the tel URI into an equivalent SIP URI at a host, with
+// the user=phone parameter as described by RFC 3261 section 19.1.6. Visual
+// separators are removed from the number, and the parameters are escaped
+// as the user part of the SIP URI.
+func (t TelURI) SIPURI(host string) URI {
+	return URI{
+		Scheme: "sip",
+		User:   unescape(t.Subscriber()),
+		Host:   host,
+		Params: HeaderArgs{{Key: "user", Value: "phone"}},
+	}
+}
+
+// Equal returns whether or not two tel URIs are equivalent according to
+// RFC 3966 section 4. Parameters may be in any order.
+func (t TelURI) Equal(other TelURI) bool {
+	if !strings.EqualFold(t.Number, other.Number) ||
+		!strings.EqualFold(t.PhoneContext, other.PhoneContext) ||
+		t.Extension != other.Extension ||
+		!strings.EqualFold(t.ISDNSubaddress, other.ISDNSubaddress) ||
+		len(t.Params) != len(other.Params) {
+		return false
+	}
+
+	a := sortedParams(t.Params)
+	b := sortedParams(other.Params)
+	for i := range a {
+		if !strings.EqualFold(a[i].Key, b[i].Key) ||
+			!strings.EqualFold(unescape(a[i].Value), unescape(b[i].Value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TelURI returns the URI as a TelURI. The URI must either be a tel URI, or
+// a SIP URI with the user=phone parameter.
+func (u URI) TelURI() (TelURI, error) {
+	if strings.EqualFold(u.Scheme, "tel") {
+		return ParseTelURI("tel:" + u.Opaque)
+	}
+
+	if u.IsSIP() && strings.EqualFold(u.Params.Get("user"), "phone") {
+		return ParseTelURI("tel:" + escapedForm(u.User, u.rawUser,
+			isUserChar))
+	}
+
+	return TelURI{}, ErrParseError
+}
+
+func sortedParams(params HeaderArgs) HeaderArgs {
+	sorted := append(HeaderArgs(nil), params...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Key) < strings.ToLower(sorted[j].Key)
+	})
+	return sorted
+}
+
+func isVisualSeparator(c byte) bool {
+	return c == '-' || c == '.' || c == '(' || c == ')'
+}
+
+func stripVisualSeparators(str string) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		if !isVisualSeparator(str[i]) {
+			b.WriteByte(str[i])
+		}
+	}
+	return b.String()
+}
+
+// validPhoneDigits reports whether str only consists of digits accepted by
+// valid and visual separators, with at least one digit.
+func validPhoneDigits(str string, valid func(byte) bool) bool {
+	digits := 0
+	for i := 0; i < len(str); i++ {
+		if valid(str[i]) {
+			digits++
+		} else if !isVisualSeparator(str[i]) {
+			return false
+		}
+	}
+	return digits > 0
+}
+
+func isGlobalNumber(str string) bool {
+	return strings.HasPrefix(str, "+") && validPhoneDigits(str[1:], isDigit)
+}
+
+func isLocalNumber(str string) bool {
+	return validPhoneDigits(str, func(c byte) bool {
+		return isHex(c) || c == '*' || c == '#'
+	})
+}
+
+func isURIChar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte(";/?:@&=+$,", c) >= 0
+}
@@ -0,0 +1,788 @@
+package sipnet
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTransactionTimeout is returned by a transaction which timed out
+// waiting for a response (timers B and F) or an ACK (timer H).
+var ErrTransactionTimeout = errors.New("sip: transaction timed out")
+
+// ErrTransactionCompleted is returned when responding to a server
+// transaction which has already sent its final response.
+var ErrTransactionCompleted = errors.New("sip: transaction completed")
+
+// ErrNoListener is returned by SendRequest on a Conn without a Listener,
+// which is needed to match responses to transactions.
+var ErrNoListener = errors.New("sip: connection has no listener")
+
+// Timers holds the RFC 3261 timer values which all of the transaction
+// timers (A to K) are derived from. Values which are 0 use the value of
+// DefaultTimers.
+type Timers struct {
+	// T1 is the round trip time estimate.
+	T1 time.Duration
+
+	// T2 is the maximum retransmit interval for non-INVITE requests and
+	// INVITE responses.
+	T2 time.Duration
+
+	// T4 is the maximum duration a message remains in the network.
+	T4 time.Duration
+}
+
+// DefaultTimers are the Timers used by listeners without Timers, which are
+// the values recommended by RFC 3261 section 17.1.1.1.
+var DefaultTimers = &Timers{
+	T1: 500 * time.Millisecond,
+	T2: 4 * time.Second,
+	T4: 5 * time.Second,
+}
+
+func (t *Timers) t1() time.Duration {
+	return duration(t.T1, DefaultTimers.T1)
+}
+
+func (t *Timers) t2() time.Duration {
+	return duration(t.T2, DefaultTimers.T2)
+}
+
+func (t *Timers) t4() time.Duration {
+	return duration(t.T4, DefaultTimers.T4)
+}
+
+func duration(value, defaultValue time.Duration) time.Duration {
+	if value <= 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+// timerD is the time an INVITE client transaction waits for response
+// retransmissions, which is 32 seconds with the default T1.
+func (t *Timers) timerD() time.Duration {
+	return 64 * t.t1()
+}
+
+// tryingDelay is the time an INVITE server transaction waits for a
+// response from the TU before sending a 100 Trying.
+const tryingDelay = 200 * time.Millisecond
+
+type transactionState int
+
+const (
+	stateCalling transactionState = iota
+	stateTrying
+	stateProceeding
+	stateAccepted
+	stateCompleted
+	stateConfirmed
+	stateTerminated
+)
+
+// transactionTable holds the active transactions of a Listener.
+type transactionTable struct {
+	mutex   sync.Mutex
+	clients map[string]*ClientTransaction
+	servers map[string]*ServerTransaction
+}
+
+func newTransactionTable() *transactionTable {
+	return &transactionTable{
+		clients: make(map[string]*ClientTransaction),
+		servers: make(map[string]*ServerTransaction),
+	}
+}
+
+// clientKey returns the key which matches responses to a client
+// transaction, which is the branch of the top Via and the method of the
+// CSeq (RFC 3261 section 17.1.3).
+func clientKey(branch, method string) string {
+	return branch + " " + method
+}
+
+// serverKey returns the key which matches requests to a server
+// transaction (RFC 3261 section 17.2.3). An ACK matches the INVITE it
+// acknowledges. Requests from RFC 2543 elements, whose branch does not
+// start with the magic cookie, are matched by their Request-URI, From tag,
+// Call-ID, CSeq number and top Via instead.
+func serverKey(req *Request) (string, bool) {
+	vias, err := ParseViaStack(&req.Header)
+	if err != nil || len(vias) == 0 {
+		return "", false
+	}
+
+	method := req.Method
+	if method == MethodAck {
+		method = MethodInvite
+	}
+
+	top := vias[0]
+	if top.HasMagicCookie() {
+		return top.Branch() + " " + strings.ToLower(top.Client) + " " +
+			method, true
+	}
+
+	cseq, err := ParseCSeq(req.Header.Get("CSeq"))
+	if err != nil {
+		return "", false
+	}
+
+	from, err := ParseUser(req.Header.Get("From"))
+	if err != nil {
+		return "", false
+	}
+
+	return req.URI.String() + " " + from.Arguments.Get("tag") + " " +
+		req.Header.Get("Call-ID") + " " + strconv.FormatUint(uint64(cseq.Seq),
+		10) + " " + top.String() + " " + method, true
+}
+
+// receive passes a message received on a connection to its transaction.
+// It returns false if the message does not belong to a transaction, or is
+// the ACK of a 2xx response, and is to be passed on to the reader of the
+// connection. New server transactions are created for requests other than
+// ACK.
+func (t *transactionTable) receive(c *Conn, msg interface{}) bool {
+	switch msg := msg.(type) {
+	case *Response:
+		vias, err := ParseViaStack(&msg.Header)
+		if err != nil || len(vias) == 0 {
+			return false
+		}
+
+		cseq, err := ParseCSeq(msg.Header.Get("CSeq"))
+		if err != nil {
+			return false
+		}
+
+		t.mutex.Lock()
+		tx := t.clients[clientKey(vias.Branch(), cseq.Method)]
+		t.mutex.Unlock()
+		if tx == nil {
+			return false
+		}
+
+		// A response must have the Vias of the request it answers. For a
+		// UA, which sends requests with a single Via, this discards
+		// responses with more than one (RFC 3261 section 18.1.2).
+		if len(vias) != tx.vias {
+			return true
+		}
+
+		tx.receive(msg)
+		return true
+	case *Request:
+		key, ok := serverKey(msg)
+		if !ok {
+			return false
+		}
+
+		t.mutex.Lock()
+		tx := t.servers[key]
+		if tx == nil && msg.Method != MethodAck {
+			t.servers[key] = newServerTransaction(c, msg, key)
+		}
+		t.mutex.Unlock()
+
+		if tx == nil {
+			return false
+		}
+
+		return tx.receive(msg)
+	}
+
+	return false
+}
+
+// server returns the server transaction of a request.
+func (t *transactionTable) server(req *Request) *ServerTransaction {
+	key, ok := serverKey(req)
+	if !ok {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.servers[key]
+}
+
+// ClientTransaction is a client transaction as described by RFC 3261
+// section 17.1, which sends a request, retransmits it on unreliable
+// transports, and receives its responses.
+type ClientTransaction struct {
+	Request *Request
+
+	conn      *Conn
+	key       string
+	vias      int
+	invite    bool
+	reliable  bool
+	timers    *Timers
+	request   []byte
+	responses chan *Response
+	done      chan struct{}
+
+	mutex    sync.Mutex
+	state    transactionState
+	interval time.Duration
+	ack      []byte
+	err      error
+
+	// delivered is set once the final response is passed to the
+	// responses channel, which is then closed by the delivering goroutine.
+	delivered bool
+
+	retransmitTimer *time.Timer // Timer A or E.
+	timeoutTimer    *time.Timer // Timer B or F.
+	waitTimer       *time.Timer // Timer D or K.
+}
+
+// SendRequest sends a request on the connection in a new client
+// transaction. If the top Via of the request has no RFC 3261 branch, a new
+// branch is set. ACK requests for 2xx responses are not sent in a
+// transaction, and should be written directly with Request.WriteTo.
+func (c *Conn) SendRequest(req *Request) (*ClientTransaction, error) {
+	if c.Listener == nil {
+		return nil, ErrNoListener
+	}
+
+	if req.Method == MethodAck {
+		return nil, errors.New("sip: ACK requests do not create transactions")
+	}
+
+	vias, err := ParseViaStack(&req.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vias) == 0 {
+		return nil, headerError("Via", "", "missing Via header")
+	}
+
+	if !vias.HasMagicCookie() {
+		branch, err := NewBranch()
+		if err != nil {
+			return nil, err
+		}
+
+		vias[0].Arguments.Set("branch", branch)
+		vias.SetHeader(&req.Header)
+	}
+
+	tx := &ClientTransaction{
+		Request:   req,
+		conn:      c,
+		key:       clientKey(vias.Branch(), req.Method),
+		vias:      len(vias),
+		invite:    req.Method == MethodInvite,
+		reliable:  c.Transport != "udp",
+		timers:    c.timers(),
+		request:   req.Marshal(),
+		responses: make(chan *Response, 16),
+		done:      make(chan struct{}),
+		state:     stateTrying,
+	}
+
+	if tx.invite {
+		tx.state = stateCalling
+	}
+
+	table := c.Listener.transactions
+	table.mutex.Lock()
+	table.clients[tx.key] = tx
+	table.mutex.Unlock()
+
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if err := c.send(tx.request); err != nil {
+		tx.terminate(err)
+		return nil, err
+	}
+
+	if !tx.reliable {
+		tx.interval = tx.timers.t1()
+		tx.retransmitTimer = time.AfterFunc(tx.interval, tx.retransmit)
+	}
+
+	tx.timeoutTimer = time.AfterFunc(64*tx.timers.t1(), tx.timeout)
+	return tx, nil
+}
+
+// Responses returns the channel which receives the responses of the
+// transaction. It is closed after the final response is received, or when
+// the transaction fails. Provisional responses are dropped if the channel
+// is not read from fast enough.
+func (tx *ClientTransaction) Responses() <-chan *Response {
+	return tx.responses
+}
+
+// Done returns a channel which is closed when the transaction terminates.
+func (tx *ClientTransaction) Done() <-chan struct{} {
+	return tx.done
+}
+
+// Err returns the error the transaction failed with, such as
+// ErrTransactionTimeout, or nil.
+func (tx *ClientTransaction) Err() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return tx.err
+}
+
+// Terminate terminates the transaction, so that it no longer retransmits
+// its request or receives responses.
+func (tx *ClientTransaction) Terminate() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.terminate(nil)
+}
+
+func (tx *ClientTransaction) receive(resp *Response) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	switch tx.state {
+	case stateCalling, stateTrying, stateProceeding:
+		if resp.IsProvisional() {
+			if tx.invite {
+				// An INVITE is no longer retransmitted once a provisional
+				// response is received.
+				stopTimer(tx.retransmitTimer)
+				stopTimer(tx.timeoutTimer)
+			}
+
+			tx.state = stateProceeding
+			select {
+			case tx.responses <- resp:
+			default:
+			}
+			return
+		}
+
+		stopTimer(tx.retransmitTimer)
+		stopTimer(tx.timeoutTimer)
+		tx.deliver(resp)
+
+		if tx.invite && resp.IsSuccess() {
+			// The TU is responsible for ACKing 2xx responses.
+			tx.terminate(nil)
+			return
+		}
+
+		tx.state = stateCompleted
+		wait := tx.timers.t4()
+		if tx.invite {
+			tx.ack = newACK(tx.Request, resp).Marshal()
+			tx.conn.send(tx.ack)
+			wait = tx.timers.timerD()
+		}
+
+		if tx.reliable {
+			tx.terminate(nil)
+			return
+		}
+
+		tx.waitTimer = time.AfterFunc(wait, tx.Terminate)
+	case stateCompleted:
+		// Retransmissions of the final response are absorbed, and
+		// acknowledged again for INVITEs.
+		if tx.invite && resp.IsFinal() {
+			tx.conn.send(tx.ack)
+		}
+	}
+}
+
+// retransmit is called by timers A and E.
+func (tx *ClientTransaction) retransmit() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	switch tx.state {
+	case stateCalling:
+		tx.interval *= 2
+	case stateTrying:
+		tx.interval *= 2
+		if tx.interval > tx.timers.t2() {
+			tx.interval = tx.timers.t2()
+		}
+	case stateProceeding:
+		tx.interval = tx.timers.t2()
+	default:
+		return
+	}
+
+	if err := tx.conn.send(tx.request); err != nil {
+		tx.terminate(err)
+		return
+	}
+
+	tx.retransmitTimer = time.AfterFunc(tx.interval, tx.retransmit)
+}
+
+// timeout is called by timers B and F.
+func (tx *ClientTransaction) timeout() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state == stateCalling || tx.state == stateTrying ||
+		tx.state == stateProceeding {
+		tx.terminate(ErrTransactionTimeout)
+	}
+}
+
+// deliver passes the final response to the TU and closes the responses
+// channel.
+func (tx *ClientTransaction) deliver(resp *Response) {
+	tx.delivered = true
+	go func() {
+		tx.responses <- resp
+		close(tx.responses)
+	}()
+}
+
+func (tx *ClientTransaction) terminate(err error) {
+	if tx.state == stateTerminated {
+		return
+	}
+
+	tx.state = stateTerminated
+	tx.err = err
+	if !tx.delivered {
+		tx.delivered = true
+		close(tx.responses)
+	}
+
+	stopTimer(tx.retransmitTimer)
+	stopTimer(tx.timeoutTimer)
+	stopTimer(tx.waitTimer)
+
+	table := tx.conn.Listener.transactions
+	table.mutex.Lock()
+	if table.clients[tx.key] == tx {
+		delete(table.clients, tx.key)
+	}
+	table.mutex.Unlock()
+
+	close(tx.done)
+}
+
+// newACK returns the ACK for a non-2xx final response to an INVITE, as
+// described by RFC 3261 section 17.1.1.3.
+func newACK(invite *Request, resp *Response) *Request {
+	ack := NewRequest()
+	ack.Method = MethodAck
+	ack.URI = invite.URI
+
+	if vias, err := ParseViaStack(&invite.Header); err == nil && len(vias) > 0 {
+		ack.Header.Set("Via", vias[0].String())
+	}
+
+	for _, route := range invite.Header.Values("Route") {
+		ack.Header.Add("Route", route)
+	}
+
+	ack.Header.Set("Max-Forwards", strconv.Itoa(DefaultMaxForwards))
+	ack.Header.Set("From", invite.Header.Get("From"))
+	ack.Header.Set("To", resp.Header.Get("To"))
+	ack.Header.Set("Call-ID", invite.Header.Get("Call-ID"))
+
+	if cseq, err := ParseCSeq(invite.Header.Get("CSeq")); err == nil {
+		ack.Header.Set("CSeq", CSeq{Seq: cseq.Seq, Method: MethodAck}.String())
+	}
+
+	return ack
+}
+
+// ServerTransaction is a server transaction as described by RFC 3261
+// section 17.2, which is created for each request received by a Listener
+// (except ACKs). It absorbs retransmissions of the request, and
+// retransmits its final response on unreliable transports. After a 2xx
+// response to an INVITE, it stays in the Accepted state of RFC 6026 for
+// 64*T1 (timer L), so that retransmissions of the INVITE are absorbed
+// while the TU retransmits the 2xx.
+type ServerTransaction struct {
+	Request *Request
+
+	conn     *Conn
+	key      string
+	invite   bool
+	reliable bool
+	timers   *Timers
+	done     chan struct{}
+
+	mutex    sync.Mutex
+	state    transactionState
+	interval time.Duration
+	response []byte
+	final    *Response
+	err      error
+
+	tryingTimer     *time.Timer
+	retransmitTimer *time.Timer // Timer G.
+	timeoutTimer    *time.Timer // Timer H, I, J or L.
+}
+
+func newServerTransaction(c *Conn, req *Request,
+	key string) *ServerTransaction {
+	tx := &ServerTransaction{
+		Request:  req,
+		conn:     c,
+		key:      key,
+		invite:   req.Method == MethodInvite,
+		reliable: c.Transport != "udp",
+		timers:   c.timers(),
+		done:     make(chan struct{}),
+		state:    stateTrying,
+	}
+
+	// The timers may fire before they are assigned.
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.invite {
+		tx.state = stateProceeding
+		tx.tryingTimer = time.AfterFunc(tryingDelay, tx.sendTrying)
+	} else {
+		tx.timeoutTimer = time.AfterFunc(64*tx.timers.t1(), tx.abandon)
+	}
+
+	// The tag is generated before the request is passed on, so that
+	// shallow copies of it, such as by WithContext, share the tag.
+	req.localTag()
+	return tx
+}
+
+// ServerTransaction returns the server transaction of a request received
+// on the connection, or nil if it has none or it has terminated.
+func (c *Conn) ServerTransaction(req *Request) *ServerTransaction {
+	if c.Listener == nil {
+		return nil
+	}
+
+	return c.Listener.transactions.server(req)
+}
+
+// Respond sends a response in the transaction. The response is sent as is,
+// and should be built with NewResponseFor. Responding after a final
+// response returns ErrTransactionCompleted, except for retransmissions of
+// 2xx responses to an INVITE, which are the responsibility of the TU.
+func (tx *ServerTransaction) Respond(resp *Response) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state == stateAccepted && resp.IsSuccess() {
+		return tx.conn.send(resp.Marshal())
+	}
+
+	if tx.state != stateTrying && tx.state != stateProceeding {
+		return ErrTransactionCompleted
+	}
+
+	stopTimer(tx.tryingTimer)
+	tx.response = resp.Marshal()
+	if err := tx.conn.send(tx.response); err != nil {
+		return err
+	}
+
+	if resp.IsProvisional() {
+		tx.state = stateProceeding
+		return nil
+	}
+
+	tx.final = resp
+	stopTimer(tx.timeoutTimer)
+	if tx.invite && resp.IsSuccess() {
+		tx.state = stateAccepted
+		tx.timeoutTimer = time.AfterFunc(64*tx.timers.t1(), tx.Terminate)
+		return nil
+	}
+
+	tx.state = stateCompleted
+	if tx.invite {
+		if !tx.reliable {
+			tx.interval = tx.timers.t1()
+			tx.retransmitTimer = time.AfterFunc(tx.interval, tx.retransmit)
+		}
+
+		tx.timeoutTimer = time.AfterFunc(64*tx.timers.t1(), tx.timeout)
+		return nil
+	}
+
+	if tx.reliable {
+		tx.terminate(nil)
+		return nil
+	}
+
+	tx.timeoutTimer = time.AfterFunc(64*tx.timers.t1(), tx.Terminate)
+	return nil
+}
+
+// Done returns a channel which is closed when the transaction terminates.
+func (tx *ServerTransaction) Done() <-chan struct{} {
+	return tx.done
+}
+
+// Err returns ErrTransactionTimeout if the ACK of a non-2xx final response
+// to an INVITE was never received, or if a non-INVITE request was not
+// responded to within 64*T1, after which the client has given up on it.
+// Otherwise it returns nil.
+func (tx *ServerTransaction) Err() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return tx.err
+}
+
+// Terminate terminates the transaction, so that retransmissions of its
+// request are passed on to the TU.
+func (tx *ServerTransaction) Terminate() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	tx.terminate(nil)
+}
+
+// receive handles a retransmission of the request, or an ACK. It returns
+// false if the request is to be passed on to the TU, which is the case for
+// the ACK of a 2xx response.
+func (tx *ServerTransaction) receive(req *Request) bool {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if req.Method == MethodAck {
+		if tx.state == stateAccepted {
+			return false
+		} else if tx.state != stateCompleted {
+			return true
+		}
+
+		tx.state = stateConfirmed
+		stopTimer(tx.retransmitTimer)
+		stopTimer(tx.timeoutTimer)
+		if tx.reliable {
+			tx.terminate(nil)
+			return true
+		}
+
+		tx.timeoutTimer = time.AfterFunc(tx.timers.t4(), tx.Terminate)
+		return true
+	}
+
+	// In the Accepted state, the 2xx is retransmitted by the TU rather
+	// than in response to the request (RFC 6026 section 8.7).
+	if tx.response == nil || tx.state == stateConfirmed ||
+		tx.state == stateAccepted {
+		return true
+	}
+
+	tx.conn.send(tx.response)
+	return true
+}
+
+// answered reports whether a final response was sent in the transaction,
+// or it has terminated.
+func (tx *ServerTransaction) answered() bool {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return tx.final != nil || tx.state == stateTerminated
+}
+
+// accepted reports whether the transaction is of an INVITE which was
+// answered with a 2xx response.
+func (tx *ServerTransaction) accepted() bool {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+	return tx.invite && tx.final != nil && tx.final.IsSuccess()
+}
+
+// sendTrying sends a 100 Trying if the TU has not responded to an INVITE
+// in time.
+func (tx *ServerTransaction) sendTrying() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state != stateProceeding || tx.response != nil {
+		return
+	}
+
+	trying, err := NewResponseFor(tx.Request, StatusTrying, "").
+		withRequest(tx.conn, tx.Request)
+	if err != nil {
+		return
+	}
+
+	tx.response = trying.Marshal()
+	tx.conn.send(tx.response)
+}
+
+// retransmit is called by timer G.
+func (tx *ServerTransaction) retransmit() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state != stateCompleted {
+		return
+	}
+
+	tx.conn.send(tx.response)
+	tx.interval *= 2
+	if tx.interval > tx.timers.t2() {
+		tx.interval = tx.timers.t2()
+	}
+
+	tx.retransmitTimer = time.AfterFunc(tx.interval, tx.retransmit)
+}
+
+// abandon is called 64*T1 after a non-INVITE request is received, and
+// terminates the transaction if the TU has not sent a final response, as
+// the client transaction has timed out by then (timer F).
+func (tx *ServerTransaction) abandon() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state == stateTrying || tx.state == stateProceeding {
+		tx.terminate(ErrTransactionTimeout)
+	}
+}
+
+// timeout is called by timer H.
+func (tx *ServerTransaction) timeout() {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.state == stateCompleted {
+		tx.terminate(ErrTransactionTimeout)
+	}
+}
+
+func (tx *ServerTransaction) terminate(err error) {
+	if tx.state == stateTerminated {
+		return
+	}
+
+	tx.state = stateTerminated
+	tx.err = err
+	stopTimer(tx.tryingTimer)
+	stopTimer(tx.retransmitTimer)
+	stopTimer(tx.timeoutTimer)
+
+	table := tx.conn.Listener.transactions
+	table.mutex.Lock()
+	if table.servers[tx.key] == tx {
+		delete(table.servers, tx.key)
+	}
+	table.mutex.Unlock()
+
+	close(tx.done)
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
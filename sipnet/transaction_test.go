@@ -0,0 +1,375 @@
+package sipnet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTimers are short enough for retransmissions to be seen quickly, while
+// the 64*T1 timeouts (3.2 seconds) leave plenty of time for each step of a
+// test on a loaded machine.
+var testTimers = &Timers{
+	T1: 50 * time.Millisecond,
+	T2: 200 * time.Millisecond,
+	T4: 100 * time.Millisecond,
+}
+
+// testWait bounds how long a test waits for a message or a timer, and is
+// only reached when the test fails.
+const testWait = 10 * time.Second
+
+// newTestPeer returns a listener with testTimers, and a UDP socket which
+// plays the other UA.
+func newTestPeer(t *testing.T) (*Listener, *net.UDPConn) {
+	t.Helper()
+	return newTestPeerTimers(t, testTimers)
+}
+
+// newTestPeerTimers is like newTestPeer, with the listener using timers.
+func newTestPeerTimers(t *testing.T, timers *Timers) (*Listener,
+	*net.UDPConn) {
+	t.Helper()
+	l, err := (&ListenConfig{Timers: timers}).Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		peer.Close()
+		l.Close()
+	})
+	return l, peer
+}
+
+// readPeer reads a datagram received by the peer.
+func readPeer(t *testing.T, peer *net.UDPConn) interface{} {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(testWait))
+	data := make([]byte, 65535)
+	n, err := peer.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := DefaultParserConfig.readDatagram(data[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// testToken returns a random token, for the branch and Call-ID of test
+// requests.
+func testToken(n int) string {
+	token, err := randomToken(n)
+	if err != nil {
+		panic(err)
+	}
+
+	return token
+}
+
+func testRequest(method string) *Request {
+	req := NewRequest()
+	req.Method = method
+	req.URI = URI{Scheme: "sip", User: "bob", Host: "127.0.0.1"}
+	req.Header.Set("Via", "SIP/2.0/UDP 127.0.0.1;branch="+MagicCookie+
+		testToken(12))
+	req.Header.Set("Max-Forwards", "70")
+	req.Header.Set("From", "<sip:alice@127.0.0.1>;tag=1")
+	req.Header.Set("To", "<sip:bob@127.0.0.1>")
+	req.Header.Set("Call-ID", testToken(8))
+	req.Header.Set("CSeq", CSeq{Seq: 1, Method: method}.String())
+	return req
+}
+
+func TestInviteClientTransaction(t *testing.T) {
+	t.Parallel()
+	l, peer := newTestPeer(t)
+	conn := l.getUDPConnFromPool(peer.LocalAddr())
+	invite := testRequest(MethodInvite)
+
+	tx, err := conn.SendRequest(invite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timer A retransmits the INVITE until a response is received.
+	first := readPeer(t, peer).(*Request)
+	again := readPeer(t, peer).(*Request)
+	if !bytes.Equal(first.Marshal(), again.Marshal()) {
+		t.Fatalf("retransmission %q differs from %q", again.Marshal(),
+			first.Marshal())
+	}
+
+	busy := NewResponseFor(first, StatusBusyHere, "")
+	busy.Header.Set("To", "<sip:bob@127.0.0.1>;tag=2")
+	for i := 0; i < 2; i++ {
+		peer.WriteTo(busy.Marshal(), l.udpListener.LocalAddr())
+
+		// Every copy of the final response is acknowledged.
+		var ack *Request
+		for ack == nil {
+			if req := readPeer(t, peer).(*Request); req.Method == MethodAck {
+				ack = req
+			}
+		}
+
+		if ack.Header.Get("To") != busy.Header.Get("To") ||
+			ack.Header.Get("Via") != first.Header.Get("Via") ||
+			ack.Header.Get("CSeq") != "1 ACK" {
+			t.Fatalf("unexpected ACK %q", ack.Marshal())
+		}
+	}
+
+	var final *Response
+	for resp := range tx.Responses() {
+		final = resp
+	}
+
+	if final == nil || final.StatusCode != StatusBusyHere {
+		t.Fatalf("got final response %v, want 486", final)
+	}
+
+	// Timer D terminates the transaction.
+	select {
+	case <-tx.Done():
+	case <-time.After(testWait):
+		t.Fatal("transaction did not terminate")
+	}
+
+	if tx.Err() != nil {
+		t.Fatalf("unexpected error: %v", tx.Err())
+	}
+}
+
+func TestClientTransactionTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Nothing else happens before timer F, so it can be short.
+	l, peer := newTestPeerTimers(t, &Timers{T1: 5 * time.Millisecond})
+	conn := l.getUDPConnFromPool(peer.LocalAddr())
+
+	tx, err := conn.SendRequest(testRequest(MethodOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range tx.Responses() {
+		t.Fatal("unexpected response")
+	}
+
+	if tx.Err() != ErrTransactionTimeout {
+		t.Fatalf("got error %v, want ErrTransactionTimeout", tx.Err())
+	}
+}
+
+func TestClientTransactionVias(t *testing.T) {
+	t.Parallel()
+	l, peer := newTestPeer(t)
+	conn := l.getUDPConnFromPool(peer.LocalAddr())
+
+	tx, err := conn.SendRequest(testRequest(MethodOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := readPeer(t, peer).(*Request)
+
+	// A response with more Vias than the request is discarded (RFC 3261
+	// section 18.1.2). Datagrams from the peer are handled in order, so
+	// it would be received before the 200 if it was passed on.
+	bcast := NewResponseFor(options, StatusBusyHere, "")
+	bcast.Header.Add("Via", "SIP/2.0/UDP 255.255.255.255;branch=z9hG4bK1")
+	peer.WriteTo(bcast.Marshal(), l.udpListener.LocalAddr())
+	peer.WriteTo(NewResponseFor(options, StatusOK, "").Marshal(),
+		l.udpListener.LocalAddr())
+
+	select {
+	case resp := <-tx.Responses():
+		if resp.StatusCode != StatusOK {
+			t.Fatalf("got %d, want 200", resp.StatusCode)
+		}
+	case <-time.After(testWait):
+		t.Fatal("no response was received")
+	}
+}
+
+func TestServerTransactionRetransmission(t *testing.T) {
+	t.Parallel()
+	l, peer := newTestPeer(t)
+	options := testRequest(MethodOptions)
+	peer.WriteTo(options.Marshal(), l.udpListener.LocalAddr())
+
+	req, conn, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewResponseFor(req, StatusOK, "").WriteTo(conn, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := readPeer(t, peer).(*Response); resp.StatusCode != StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+
+	// A retransmitted request is answered by the transaction, and not
+	// passed on again.
+	peer.WriteTo(options.Marshal(), l.udpListener.LocalAddr())
+	if resp := readPeer(t, peer).(*Response); resp.StatusCode != StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+
+	if tx := conn.ServerTransaction(req); tx == nil {
+		t.Fatal("transaction terminated before timer J")
+	} else if err := tx.Respond(NewResponseFor(req, StatusOK, "")); err !=
+		ErrTransactionCompleted {
+		t.Fatalf("got error %v, want ErrTransactionCompleted", err)
+	}
+}
+
+func TestInviteServerTransaction(t *testing.T) {
+	t.Parallel()
+	l, peer := newTestPeer(t)
+	invite := testRequest(MethodInvite)
+	peer.WriteTo(invite.Marshal(), l.udpListener.LocalAddr())
+
+	req, conn, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 100 Trying is sent when the TU does not respond in time.
+	if resp := readPeer(t, peer).(*Response); resp.StatusCode != StatusTrying {
+		t.Fatalf("got %d, want 100", resp.StatusCode)
+	}
+
+	tx := conn.ServerTransaction(req)
+	NewResponseFor(req, StatusNotFound, "").WriteTo(conn, req)
+
+	// Timer G retransmits the final response until it is acknowledged.
+	for i := 0; i < 2; i++ {
+		if resp := readPeer(t, peer).(*Response); resp.StatusCode !=
+			StatusNotFound {
+			t.Fatalf("got %d, want 404", resp.StatusCode)
+		}
+	}
+
+	ack := testRequest(MethodAck)
+	ack.Header = invite.Header.Clone()
+	ack.Header.Set("CSeq", "1 ACK")
+	peer.WriteTo(ack.Marshal(), l.udpListener.LocalAddr())
+
+	select {
+	case <-tx.Done():
+	case <-time.After(testWait):
+		t.Fatal("transaction did not terminate")
+	}
+
+	if tx.Err() != nil {
+		t.Fatalf("unexpected error: %v", tx.Err())
+	}
+}
+
+func TestInviteServerTransactionAccepted(t *testing.T) {
+	t.Parallel()
+	l, peer := newTestPeer(t)
+	invite := testRequest(MethodInvite)
+	peer.WriteTo(invite.Marshal(), l.udpListener.LocalAddr())
+
+	req, conn, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := conn.ServerTransaction(req)
+	ok := NewResponseFor(req, StatusOK, "")
+	if err := ok.WriteTo(conn, req); err != nil {
+		t.Fatal(err)
+	}
+
+	readOK := func() {
+		t.Helper()
+		for {
+			resp := readPeer(t, peer).(*Response)
+			if resp.StatusCode == StatusOK {
+				return
+			} else if resp.StatusCode != StatusTrying {
+				t.Fatalf("got %d, want 200", resp.StatusCode)
+			}
+		}
+	}
+	readOK()
+
+	// A retransmitted INVITE is absorbed, while the ACK of the 2xx is
+	// passed on. Datagrams from the peer are handled in order, so the
+	// INVITE would be accepted before the ACK if it was passed on.
+	ack := testRequest(MethodAck)
+	ack.Header = invite.Header.Clone()
+	ack.Header.Set("To", ok.Header.Get("To"))
+	ack.Header.Set("CSeq", "1 ACK")
+	peer.WriteTo(invite.Marshal(), l.udpListener.LocalAddr())
+	peer.WriteTo(ack.Marshal(), l.udpListener.LocalAddr())
+
+	received, _, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	} else if received.Method != MethodAck {
+		t.Fatalf("got %s, want ACK", received.Method)
+	}
+
+	// The TU retransmits the 2xx in the transaction until timer L.
+	if err := ok.WriteTo(conn, req); err != nil {
+		t.Fatalf("2xx retransmission failed: %v", err)
+	}
+	readOK()
+
+	select {
+	case <-tx.Done():
+	case <-time.After(testWait):
+		t.Fatal("timer L did not terminate the transaction")
+	}
+
+	if tx.Err() != nil {
+		t.Fatalf("unexpected error: %v", tx.Err())
+	}
+}
+
+func TestServerTransactionUnanswered(t *testing.T) {
+	t.Parallel()
+
+	// The transaction is only waited for, so timer F can be short.
+	l, peer := newTestPeerTimers(t, &Timers{T1: 5 * time.Millisecond})
+	peer.WriteTo(testRequest(MethodOptions).Marshal(),
+		l.udpListener.LocalAddr())
+
+	req, conn, err := l.AcceptRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction may have terminated already on a slow machine.
+	if tx := conn.ServerTransaction(req); tx != nil {
+		select {
+		case <-tx.Done():
+		case <-time.After(testWait):
+			t.Fatal("unanswered transaction did not terminate")
+		}
+
+		if tx.Err() != ErrTransactionTimeout {
+			t.Fatalf("got error %v, want ErrTransactionTimeout", tx.Err())
+		}
+	}
+
+	if conn.ServerTransaction(req) != nil {
+		t.Fatal("unanswered transaction was not removed")
+	}
+}
@@ -1,52 +1,528 @@
 package sipnet
 
 import (
-	"regexp"
+	"net"
+	"strconv"
 	"strings"
 )
 
-var uriRegexp = regexp.MustCompile("^([A-Za-z]+):([^@]+)@([^\\s;]+)(.*)$")
-
-// URI represents a Uniform Resource Identifier.
+// URI represents a Uniform Resource Identifier. SIP and SIPS URIs are parsed
+// into their components as defined by RFC 3261 section 19.1. URIs of other
+// schemes only have their Scheme and Opaque fields set, tel URIs can be
+// further parsed with the TelURI method.
 type URI struct {
-	Scheme    string
-	Username  string
-	Domain    string
-	Arguments HeaderArgs
+	Scheme string
+
+	// User and Password are stored unescaped.
+	User     string
+	Password string
+
+	// Host does not include the square brackets of IPv6 references.
+	Host string
+
+	// Port is 0 if the URI does not specify a port. A port is written as
+	// it was parsed, such as ":0" or ":05060", as long as Port is not
+	// changed.
+	Port int
+
+	// Params and Headers hold the URI parameters (after ";") and the
+	// URI headers (after "?") with their values escaped as they appear in
+	// the URI.
+	Params  HeaderArgs
+	Headers HeaderArgs
+
+	// Opaque holds everything after the colon for URIs whose scheme is not
+	// sip or sips.
+	Opaque string
+
+	rawUser     string
+	rawPassword string
+	rawPort     string
 }
 
 // ParseURI parses a given URI into a URI struct.
 func ParseURI(str string) (URI, error) {
-	result := uriRegexp.FindStringSubmatch(str)
-	if len(result) == 0 {
+	colon := strings.IndexByte(str, ':')
+	if colon <= 0 || !isScheme(str[:colon]) {
 		return URI{}, ErrParseError
 	}
 
-	arguments := make(HeaderArgs)
-	if result[4] != "" && result[4][0] == ';' {
-		arguments = ParseHeaderArgs(strings.TrimSpace(result[4][1:]))
+	u := URI{Scheme: str[:colon]}
+	rest := str[colon+1:]
+
+	if !u.IsSIP() {
+		if rest == "" || strings.IndexFunc(rest, isOpaqueInvalid) >= 0 {
+			return URI{}, ErrParseError
+		}
+
+		if strings.EqualFold(u.Scheme, "tel") {
+			if _, err := ParseTelURI(str); err != nil {
+				return URI{}, err
+			}
+		}
+
+		u.Opaque = rest
+		return u, nil
 	}
 
-	return URI{
-		Scheme:    result[1],
-		Username:  result[2],
-		Domain:    result[3],
-		Arguments: arguments,
-	}, nil
+	if at := strings.IndexByte(rest, '@'); at >= 0 {
+		if err := u.parseUserinfo(rest[:at]); err != nil {
+			return URI{}, err
+		}
+		rest = rest[at+1:]
+	}
+
+	end := strings.IndexAny(rest, ";?")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	if err := u.parseHostport(rest[:end]); err != nil {
+		return URI{}, err
+	}
+	rest = rest[end:]
+
+	if rest != "" && rest[0] == ';' {
+		end = strings.IndexByte(rest, '?')
+		if end < 0 {
+			end = len(rest)
+		}
+
+		params, err := parseURIArgs(rest[1:end], ';', isParamChar, false)
+		if err != nil {
+			return URI{}, err
+		}
+
+		u.Params = params
+		rest = rest[end:]
+	}
+
+	if rest != "" && rest[0] == '?' {
+		headers, err := parseURIArgs(rest[1:], '&', isHeaderChar, true)
+		if err != nil {
+			return URI{}, err
+		}
+
+		u.Headers = headers
+	}
+
+	return u, nil
+}
+
+func (u *URI) parseUserinfo(userinfo string) error {
+	user := userinfo
+	password := ""
+	if colon := strings.IndexByte(userinfo, ':'); colon >= 0 {
+		user = userinfo[:colon]
+		password = userinfo[colon+1:]
+	}
+
+	if user == "" || !validEscaped(user, isUserChar) ||
+		!validEscaped(password, isPasswordChar) {
+		return ErrParseError
+	}
+
+	u.User = unescape(user)
+	u.Password = unescape(password)
+	u.rawUser = user
+	u.rawPassword = password
+	return nil
 }
 
-// String returns the full text representation of the URI with additional
-// semicolon arguments.
+func (u *URI) parseHostport(hostport string) error {
+	host := hostport
+	port := ""
+
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return ErrParseError
+		}
+
+		host = hostport[1:end]
+		if !strings.Contains(host, ":") || net.ParseIP(host) == nil {
+			return ErrParseError
+		}
+
+		rest := hostport[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return ErrParseError
+			}
+			port = rest[1:]
+		}
+	} else {
+		if colon := strings.IndexByte(hostport, ':'); colon >= 0 {
+			host = hostport[:colon]
+			port = hostport[colon+1:]
+		}
+
+		if !isHostname(host) {
+			return ErrParseError
+		}
+	}
+
+	u.Host = host
+
+	if port == "" {
+		if strings.HasSuffix(hostport, ":") {
+			return ErrParseError
+		}
+		return nil
+	}
+
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return ErrParseError
+		}
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p > 65535 {
+		return ErrParseError
+	}
+
+	u.Port = p
+	u.rawPort = port
+	return nil
+}
+
+func parseURIArgs(str string, sep byte, valid func(byte) bool,
+	requireValue bool) (HeaderArgs, error) {
+	var args HeaderArgs
+	for _, arg := range strings.Split(str, string(sep)) {
+		key := arg
+		value := ""
+		hasValue := false
+		if eq := strings.IndexByte(arg, '='); eq >= 0 {
+			key = arg[:eq]
+			value = arg[eq+1:]
+			hasValue = true
+		}
+
+		if key == "" || !validEscaped(key, valid) ||
+			!validEscaped(value, valid) || requireValue && !hasValue ||
+			!requireValue && hasValue && value == "" {
+			return nil, ErrParseError
+		}
+
+		args = append(args, HeaderArg{Key: key, Value: value})
+	}
+
+	return args, nil
+}
+
+// IsSIP returns whether or not the URI is a SIP or SIPS URI.
+func (u URI) IsSIP() bool {
+	return strings.EqualFold(u.Scheme, "sip") ||
+		strings.EqualFold(u.Scheme, "sips")
+}
+
+// String returns the full text representation of the URI, including its
+// parameters and headers.
 func (u URI) String() string {
-	return u.SchemeUserDomain() + u.Arguments.SemicolonString()
+	if !u.IsSIP() {
+		return u.Scheme + ":" + u.Opaque
+	}
+
+	result := u.SchemeUserDomain()
+
+	for _, param := range u.Params {
+		result += ";" + param.Key
+		if param.Value != "" {
+			result += "=" + param.Value
+		}
+	}
+
+	for i, header := range u.Headers {
+		if i == 0 {
+			result += "?"
+		} else {
+			result += "&"
+		}
+		result += header.Key + "=" + header.Value
+	}
+
+	return result
 }
 
-// SchemeUserDomain returns the text representation of the scheme:user@domain.
+// SchemeUserDomain returns the text representation of the scheme:user@domain,
+// without the URI's parameters and headers.
 func (u URI) SchemeUserDomain() string {
 	return u.Scheme + ":" + u.UserDomain()
 }
 
-// UserDomain returns the text representation of user@domain.
+// UserDomain returns the text representation of user@domain, where domain
+// includes the port if there is one. The user part is omitted if the URI
+// has no user.
 func (u URI) UserDomain() string {
-	return u.Username + "@" + u.Domain
+	result := u.HostPort()
+	if u.User == "" {
+		return result
+	}
+
+	userinfo := escapedForm(u.User, u.rawUser, isUserChar)
+	if u.Password != "" {
+		userinfo += ":" + escapedForm(u.Password, u.rawPassword,
+			isPasswordChar)
+	}
+
+	return userinfo + "@" + result
+}
+
+// HostPort returns the host and port of the URI, with IPv6 addresses
+// enclosed in square brackets.
+func (u URI) HostPort() string {
+	host := u.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if u.rawPort != "" {
+		if p, err := strconv.Atoi(u.rawPort); err == nil && p == u.Port {
+			return host + ":" + u.rawPort
+		}
+	}
+
+	if u.Port != 0 {
+		return host + ":" + strconv.Itoa(u.Port)
+	}
+
+	return host
+}
+
+// isOpaqueInvalid reports whether r cannot appear in the opaque part of a
+// URI, as it is white space, a control character or a delimiter.
+func isOpaqueInvalid(r rune) bool {
+	return r <= ' ' || r == 0x7f || r == '<' || r == '>' || r == '"'
+}
+
+func isScheme(str string) bool {
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if isAlpha(c) || i > 0 && (isDigit(c) || c == '+' || c == '-' ||
+			c == '.') {
+			continue
+		}
+		return false
+	}
+	return str != ""
+}
+
+func isHostname(str string) bool {
+	if str == "" {
+		return false
+	}
+
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if !isAlpha(c) && !isDigit(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isUnreserved(c byte) bool {
+	return isAlpha(c) || isDigit(c) || strings.IndexByte("-_.!~*'()", c) >= 0
+}
+
+func isUserChar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("&=+$,;?/", c) >= 0
+}
+
+func isPasswordChar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("&=+$,", c) >= 0
+}
+
+func isParamChar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("[]/:&+$", c) >= 0
+}
+
+func isHeaderChar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("[]/?:+$", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// validEscaped reports whether str only consists of characters accepted by
+// valid and valid escape sequences.
+func validEscaped(str string, valid func(byte) bool) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] == '%' {
+			if i+2 >= len(str) || !isHex(str[i+1]) || !isHex(str[i+2]) {
+				return false
+			}
+			i += 2
+			continue
+		}
+
+		if !valid(str[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func unhex(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// unescape decodes the escape sequences of a string which has been checked
+// with validEscaped.
+func unescape(str string) string {
+	if !strings.Contains(str, "%") {
+		return str
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] == '%' {
+			b.WriteByte(unhex(str[i+1])<<4 | unhex(str[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(str[i])
+	}
+	return b.String()
+}
+
+// escape escapes the characters of a string not accepted by valid.
+func escape(str string, valid func(byte) bool) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		if valid(str[i]) {
+			b.WriteByte(str[i])
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[str[i]>>4])
+		b.WriteByte(hex[str[i]&0xf])
+	}
+	return b.String()
+}
+
+// escapedForm returns raw if it is the escaped form of str, otherwise str
+// is escaped. It keeps the original escaping of parsed URIs.
+func escapedForm(str, raw string, valid func(byte) bool) string {
+	if raw != "" && unescape(raw) == str {
+		return raw
+	}
+
+	return escape(str, valid)
+}
+
+// uriParamsMustMatch contains the URI parameters which must match in both
+// URIs if they are present in either, as defined by RFC 3261
+// section 19.1.4.
+var uriParamsMustMatch = []string{"user", "ttl", "method", "maddr",
+	"transport"}
+
+// Equal returns whether or not two URIs are equivalent according to the
+// comparison rules of RFC 3261 section 19.1.4. The scheme, host and
+// parameters are compared case-insensitively, while the user and password
+// are compared case-sensitively. Escaped characters are compared in their
+// unescaped form. A URI without a port does not match a URI which
+// explicitly contains the default port.
+func (u URI) Equal(other URI) bool {
+	if !strings.EqualFold(u.Scheme, other.Scheme) {
+		return false
+	}
+
+	if strings.EqualFold(u.Scheme, "tel") {
+		a, errA := u.TelURI()
+		b, errB := other.TelURI()
+		if errA == nil && errB == nil {
+			return a.Equal(b)
+		}
+	}
+
+	if !u.IsSIP() {
+		return u.Opaque == other.Opaque
+	}
+
+	if u.User != other.User || u.Password != other.Password ||
+		u.Port != other.Port || !equalHost(u.Host, other.Host) {
+		return false
+	}
+
+	for _, key := range uriParamsMustMatch {
+		a, aFound := u.Params.Lookup(key)
+		b, bFound := other.Params.Lookup(key)
+		if aFound != bFound || !strings.EqualFold(unescape(a), unescape(b)) {
+			return false
+		}
+	}
+
+	for _, param := range u.Params {
+		value, found := other.Params.Lookup(param.Key)
+		if found && !strings.EqualFold(unescape(param.Value),
+			unescape(value)) {
+			return false
+		}
+	}
+
+	return equalURIHeaders(u.Headers, other.Headers) &&
+		equalURIHeaders(other.Headers, u.Headers)
+}
+
+// AddressOfRecord returns the canonical form of the URI used as an
+// address-of-record by registrars (RFC 3261 section 10.3), which has all of
+// its parameters and headers removed.
+func (u URI) AddressOfRecord() URI {
+	return URI{
+		Scheme:   u.Scheme,
+		User:     u.User,
+		Password: u.Password,
+		Host:     u.Host,
+		Port:     u.Port,
+		Opaque:   u.Opaque,
+	}
+}
+
+func equalHost(a, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+
+	return strings.EqualFold(a, b)
+}
+
+// equalURIHeaders returns whether or not every header in a is present
+// in b with the same value.
+func equalURIHeaders(a, b HeaderArgs) bool {
+	for _, header := range a {
+		found := false
+		for _, value := range b.Values(header.Key) {
+			if unescape(value) == unescape(header.Value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
 }
@@ -2,7 +2,6 @@ package sipnet
 
 import (
 	"errors"
-	"regexp"
 	"strings"
 )
 
@@ -10,54 +9,137 @@ import (
 // (i.e. a user line or via).
 var ErrParseError = errors.New("sip: parse error")
 
-var nameRegexp = regexp.MustCompile("^([^<]*)<([^>]+)>(.*)$")
-
-// User represents a SIP user.
+// User represents a SIP user, as found in the From, To, Contact, Route and
+// Record-Route headers.
 type User struct {
+	// Name is the unquoted display name of the user.
 	Name      string
 	URI       URI
 	Arguments HeaderArgs
 }
 
-// String returns the string representation of a user to be used on user lines.
+// String returns the string representation of a user to be used on user
+// lines. The display name is quoted if needed.
 func (u User) String() string {
 	if u.Name == "" {
 		return "<" + u.URI.String() + ">" + u.Arguments.SemicolonString()
 	}
-	return u.Name + " <" + u.URI.String() + ">" +
-		u.Arguments.SemicolonString()
+
+	name := u.Name
+	if !isDisplayNameTokens(name) {
+		name = quoteString(name)
+	}
+
+	return name + " <" + u.URI.String() + ">" + u.Arguments.SemicolonString()
 }
 
-// ParseUser parses a given user line into a User.
+// ParseUser parses a given user line into a User. The line may either be a
+// name-addr (i.e. `"Bob" <sip:bob@example.com>;tag=1234`) or an addr-spec
+// (i.e. `sip:bob@example.com;tag=1234`), as defined by RFC 3261
+// section 20.10. For addr-spec lines, any semicolon separated parameters
+// are the user's arguments rather than URI parameters, so a URI with
+// headers must be enclosed in angle brackets. White space is not allowed
+// inside the angle brackets.
 func ParseUser(str string) (User, error) {
-	result := nameRegexp.FindStringSubmatch(str)
-	if len(result) == 0 {
-		uri, err := ParseURI(str)
+	str = strings.TrimSpace(str)
+
+	var user User
+	var rest string
+
+	switch {
+	case strings.HasPrefix(str, "\""):
+		name, n, err := readQuotedString(str)
+		if err != nil {
+			return User{}, err
+		}
+
+		rest = strings.TrimLeft(str[n:], " \t")
+		if !strings.HasPrefix(rest, "<") {
+			return User{}, ErrParseError
+		}
+
+		user.Name = name
+	case strings.IndexByte(str, '<') >= 0:
+		start := strings.IndexByte(str, '<')
+		// An unquoted display name is a sequence of tokens separated by
+		// linear white space.
+		words := strings.Fields(str[:start])
+		for _, word := range words {
+			if !isToken(word) {
+				return User{}, ErrParseError
+			}
+		}
+
+		user.Name = strings.Join(words, " ")
+
+		rest = str[start:]
+	default:
+		end := strings.IndexByte(str, ';')
+		if end < 0 {
+			end = len(str)
+		}
+
+		addrSpec := strings.TrimSpace(str[:end])
+		if strings.ContainsAny(addrSpec, "?,") {
+			return User{}, ErrParseError
+		}
+
+		uri, err := ParseURI(addrSpec)
 		if err != nil {
 			return User{}, err
 		}
 
-		return User{
-			URI:       uri,
-			Arguments: make(HeaderArgs),
-		}, nil
+		user.URI = uri
+		user.Arguments, err = parseSemicolonArgs(str[end:])
+		if err != nil {
+			return User{}, err
+		}
+
+		return user, nil
+	}
+
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return User{}, ErrParseError
 	}
 
-	uri, err := ParseURI(strings.TrimSpace(result[2]))
+	uri, err := ParseURI(rest[1:end])
 	if err != nil {
 		return User{}, err
 	}
 
-	return User{
-		Name:      strings.TrimSpace(result[1]),
-		URI:       uri,
-		Arguments: ParseHeaderArgs(strings.TrimSpace(result[3])),
-	}, nil
+	user.URI = uri
+	user.Arguments, err = parseSemicolonArgs(rest[end+1:])
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// ParseUserList parses a comma separated list of users, such as the value
+// of a Contact, Route or Record-Route header.
+func ParseUserList(str string) ([]User, error) {
+	var users []User
+	for _, elem := range splitList(str) {
+		user, err := ParseUser(elem)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return nil, ErrParseError
+	}
+
+	return users, nil
 }
 
 // ParseUserHeader returns the parsed users from the From, and the To fields
 // respectively from the header.
-func ParseUserHeader(h Header) (User, User, error) {
+func ParseUserHeader(h *Header) (User, User, error) {
 	var from User
 	to, err := ParseUser(h.Get("To"))
 	if err != nil {
@@ -68,3 +150,15 @@ func ParseUserHeader(h Header) (User, User, error) {
 
 	return from, to, err
 }
+
+// isDisplayNameTokens reports whether a display name can be written
+// unquoted, as a sequence of tokens separated by spaces.
+func isDisplayNameTokens(name string) bool {
+	for _, word := range strings.Split(name, " ") {
+		if !isToken(word) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,260 @@
+package sipnet
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Validator checks that requests received by a Listener are valid before
+// they are returned by AcceptRequest, as described by RFC 3261 section
+// 8.2. Invalid requests are responded to automatically.
+type Validator struct {
+	// Schemes are the Request-URI schemes which are supported. If empty,
+	// the schemes of DefaultValidator are supported.
+	Schemes []string
+
+	// Extensions are the option tags which are supported, which requests
+	// may list in their Require header.
+	Extensions []string
+
+	// RequiredExtensions are the option tags which requests must list in
+	// their Supported or Require headers.
+	RequiredExtensions []string
+
+	// ContentTypes are the media types of bodies which are supported, such
+	// as "application/sdp". If empty, the types of bodies are not checked.
+	ContentTypes []string
+}
+
+// DefaultValidator is the Validator used by listeners without a Validator.
+var DefaultValidator = &Validator{
+	Schemes: []string{"sip", "sips", "tel"},
+}
+
+// mandatoryHeaders are the headers which every request must have, as
+// described by RFC 3261 section 8.1.1.
+var mandatoryHeaders = []string{
+	"Via", "To", "From", "Call-ID", "CSeq", "Max-Forwards",
+}
+
+// singleHeaders are the headers which must not have more than one value.
+var singleHeaders = []string{
+	"To", "From", "Call-ID", "CSeq", "Max-Forwards", "Content-Length",
+}
+
+// Validate checks a request, and returns the response to send if the
+// request is invalid, or nil if it is valid. The response is one of:
+//   - 505 Version Not Supported if the SIP version is not SIP/2.0.
+//   - 400 Bad Request with a Reason header if a mandatory header is
+//     missing, malformed or repeated, the CSeq method does not match the
+//     method, the top Via has a branch which is only the magic cookie, or
+//     the Request-URI has headers.
+//   - 416 Unsupported URI Scheme if the Request-URI scheme is unsupported.
+//   - 420 Bad Extension with an Unsupported header if Require lists an
+//     unsupported option tag.
+//   - 421 Extension Required with a Require header if the request does
+//     not support one of the RequiredExtensions.
+//   - 415 Unsupported Media Type with an Accept header if the body is not
+//     one of the ContentTypes.
+//   - 406 Not Acceptable if the Accept header accepts none of the
+//     ContentTypes.
+//
+// ACK and CANCEL requests are not checked for option tags or media types.
+func (v *Validator) Validate(req *Request) *Response {
+	if !strings.EqualFold(req.SIPVersion, SIPVersion) {
+		return NewResponseFor(req, StatusVersionNotSupported, "")
+	}
+
+	if reason := checkMandatoryHeaders(req); reason != "" {
+		resp := NewResponseFor(req, StatusBadRequest, reason)
+		resp.Header.Set("Reason", reasonHeader(StatusBadRequest, reason))
+		return resp
+	}
+
+	schemes := v.Schemes
+	if len(schemes) == 0 {
+		schemes = DefaultValidator.Schemes
+	}
+
+	if !containsFold(schemes, req.URI.Scheme) {
+		return NewResponseFor(req, StatusUnsupportedURIScheme, "")
+	}
+
+	// Headers are not allowed in a Request-URI (RFC 3261 section 19.1.5).
+	if len(req.URI.Headers) > 0 {
+		reason := "Request-URI has headers"
+		resp := NewResponseFor(req, StatusBadRequest, reason)
+		resp.Header.Set("Reason", reasonHeader(StatusBadRequest, reason))
+		return resp
+	}
+
+	if req.Method == MethodAck || req.Method == MethodCancel {
+		return nil
+	}
+
+	require, err := ParseTokenList(&req.Header, "Require")
+	if err != nil {
+		return badRequest(req, err)
+	}
+
+	var unsupported []string
+	for _, tag := range require {
+		if !containsFold(v.Extensions, tag) {
+			unsupported = append(unsupported, tag)
+		}
+	}
+
+	if len(unsupported) > 0 {
+		resp := NewResponseFor(req, StatusBadExtension, "")
+		resp.Header.Set("Unsupported", FormatTokenList(unsupported))
+		return resp
+	}
+
+	supported, err := ParseTokenList(&req.Header, "Supported")
+	if err != nil {
+		return badRequest(req, err)
+	}
+
+	var missing []string
+	for _, tag := range v.RequiredExtensions {
+		if !containsFold(supported, tag) && !containsFold(require, tag) {
+			missing = append(missing, tag)
+		}
+	}
+
+	if len(missing) > 0 {
+		resp := NewResponseFor(req, StatusExtensionRequired, "")
+		resp.Header.Set("Require", FormatTokenList(missing))
+		return resp
+	}
+
+	return v.checkContentTypes(req)
+}
+
+// checkContentTypes returns the response to a request with a body or an
+// Accept header which do not match the ContentTypes, as described by
+// RFC 3261 sections 8.2.3 and 21.4.7, or nil.
+func (v *Validator) checkContentTypes(req *Request) *Response {
+	if len(v.ContentTypes) == 0 {
+		return nil
+	}
+
+	if len(req.Body) > 0 {
+		contentType, err := ParseContentType(req.Header.Get("Content-Type"))
+		if err != nil {
+			return badRequest(req, err)
+		}
+
+		if !containsFold(v.ContentTypes,
+			contentType.Type+"/"+contentType.Subtype) {
+			resp := NewResponseFor(req, StatusUnsupportedMediaType, "")
+			resp.Header.Set("Accept", strings.Join(v.ContentTypes, ", "))
+			return resp
+		}
+	}
+
+	restricted := false
+	for _, value := range req.Header.Values("Accept") {
+		if value == "" {
+			continue
+		}
+
+		mediaRange, err := ParseContentType(value)
+		if err != nil {
+			return badRequest(req, err)
+		}
+
+		restricted = true
+		for _, contentType := range v.ContentTypes {
+			if mediaRange.accepts(contentType) {
+				return nil
+			}
+		}
+	}
+
+	if restricted {
+		return NewResponseFor(req, StatusNotAcceptable, "")
+	}
+
+	return nil
+}
+
+// checkMandatoryHeaders returns the reason a request's mandatory headers
+// are invalid, or an empty string if they are valid.
+func checkMandatoryHeaders(req *Request) string {
+	for _, key := range mandatoryHeaders {
+		if _, found := req.Header.First(key); !found {
+			return "Missing " + key + " header"
+		}
+	}
+
+	for _, key := range singleHeaders {
+		if len(req.Header.Values(key)) > 1 {
+			return "Multiple " + key + " headers"
+		}
+	}
+
+	vias, err := ParseViaStack(&req.Header)
+	if err != nil || len(vias) == 0 {
+		return "Malformed Via header"
+	} else if vias[0].Branch() == MagicCookie {
+		// An RFC 3261 branch without a transaction identifier (RFC 4475
+		// section 3.2.1).
+		return "Malformed Via header"
+	}
+
+	for _, key := range []string{"To", "From"} {
+		if _, err := ParseUser(req.Header.Get(key)); err != nil {
+			return "Malformed " + key + " header"
+		}
+	}
+
+	if _, err := ParseMaxForwards(req.Header.Get("Max-Forwards")); err != nil {
+		return "Malformed Max-Forwards header"
+	}
+
+	cseq, err := ParseCSeq(req.Header.Get("CSeq"))
+	if err != nil {
+		return "Malformed CSeq header"
+	}
+
+	if cseq.Method != req.Method {
+		return "CSeq method does not match request method"
+	}
+
+	return ""
+}
+
+// badRequest returns a 400 Bad Request response to a request with a
+// header that failed to be parsed.
+func badRequest(req *Request, err error) *Response {
+	reason := "Malformed header"
+	var headerErr *HeaderError
+	if errors.As(err, &headerErr) {
+		reason = headerErr.Reason()
+	}
+
+	resp := NewResponseFor(req, StatusBadRequest, reason)
+	resp.Header.Set("Reason", reasonHeader(StatusBadRequest, reason))
+	return resp
+}
+
+// reasonHeader returns the value of a Reason header (RFC 3326) for a SIP
+// status code with a text description.
+func reasonHeader(code int, text string) string {
+	var args HeaderArgs
+	args.Set("cause", strconv.Itoa(code))
+	args.SetQuoted("text", text)
+	return "SIP" + args.SemicolonString()
+}
+
+func containsFold(list []string, str string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, str) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package sipnet
+
+import "testing"
+
+func TestValidator(t *testing.T) {
+	tel, err := ParseURI("tel:+1-201-555-0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := testRequest(MethodOptions)
+	req.URI = tel
+	if resp := DefaultValidator.Validate(req); resp != nil {
+		t.Fatalf("tel Request-URI got %d", resp.StatusCode)
+	}
+
+	sipOnly := &Validator{Schemes: []string{"sip", "sips"}}
+	if resp := sipOnly.Validate(req); resp == nil ||
+		resp.StatusCode != StatusUnsupportedURIScheme {
+		t.Fatalf("tel Request-URI without tel support got %v, want 416",
+			resp)
+	}
+
+	req.URI.Scheme = "mailto"
+	if resp := DefaultValidator.Validate(req); resp == nil ||
+		resp.StatusCode != StatusUnsupportedURIScheme {
+		t.Fatalf("mailto Request-URI got %v, want 416", resp)
+	}
+
+	for _, key := range mandatoryHeaders {
+		req := testRequest(MethodOptions)
+		req.Header.Del(key)
+		resp := DefaultValidator.Validate(req)
+		if resp == nil || resp.StatusCode != StatusBadRequest ||
+			resp.Status != "Missing "+key+" header" {
+			t.Errorf("request without %s got %v, want 400", key, resp)
+		}
+	}
+
+	for _, key := range singleHeaders {
+		req := testRequest(MethodOptions)
+		req.Header.Set("Content-Length", "0")
+		req.Header.Add(key, req.Header.Get(key))
+		resp := DefaultValidator.Validate(req)
+		if resp == nil || resp.StatusCode != StatusBadRequest {
+			t.Errorf("two %s headers got %v, want 400", key, resp)
+		}
+	}
+}
+
+func TestValidatorContentTypes(t *testing.T) {
+	v := &Validator{ContentTypes: []string{"application/sdp"}}
+	tests := []struct {
+		contentType string
+		accept      []string
+		want        int
+	}{
+		{"application/sdp", nil, 0},
+		{"Application/SDP", []string{"application/*"}, 0},
+		{"text/plain", nil, StatusUnsupportedMediaType},
+		{"", []string{"text/html", "*/*"}, 0},
+		{"", []string{"text/html"}, StatusNotAcceptable},
+		{"", []string{""}, 0},
+	}
+
+	for _, test := range tests {
+		req := testRequest(MethodInvite)
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+			req.Body = []byte("v=0\r\n")
+		}
+
+		for _, accept := range test.accept {
+			req.Header.Add("Accept", accept)
+		}
+
+		got := 0
+		if resp := v.Validate(req); resp != nil {
+			got = resp.StatusCode
+			if got == StatusUnsupportedMediaType &&
+				resp.Header.Get("Accept") != "application/sdp" {
+				t.Errorf("415 has Accept %q", resp.Header.Get("Accept"))
+			}
+		}
+
+		if got != test.want {
+			t.Errorf("%q with Accept %q got %d, want %d", test.contentType,
+				test.accept, got, test.want)
+		}
+	}
+}
@@ -1,33 +1,87 @@
 package sipnet
 
 import (
-	"regexp"
+	"net"
 	"strings"
 )
 
-var viaRegexp = regexp.MustCompile("^(SIP\\/[^\\/]+)\\/([^ ]+) ([^;]+)(.+)$")
+// MagicCookie is the prefix of branch parameters generated by RFC 3261
+// compliant elements.
+const MagicCookie = "z9hG4bK"
 
-// Via represents the contents of the Via header line.
+// Via represents the contents of a single Via header value (i.e. a hop).
 type Via struct {
 	SIPVersion string
 	Transport  string
-	Client     string
-	Arguments  HeaderArgs
+
+	// Client is the sent-by of the Via, which is the host and optional port
+	// of the client.
+	Client    string
+	Arguments HeaderArgs
 }
 
-// ParseVia parses a given Via header value into a Via.
+// ViaStack represents all of the Via hops of a message, with the most
+// recent hop first.
+type ViaStack []Via
+
+// ParseVia parses a given Via header value into a Via. The value must
+// contain a single hop.
 func ParseVia(str string) (Via, error) {
-	result := viaRegexp.FindStringSubmatch(str)
-	if len(result) == 0 {
+	str = strings.TrimSpace(str)
+
+	name, str := readToken(str)
+	version, str, ok := readSlashToken(str)
+	if !ok || name == "" {
+		return Via{}, ErrParseError
+	}
+
+	transport, str, ok := readSlashToken(str)
+	if !ok {
+		return Via{}, ErrParseError
+	}
+
+	rest := strings.TrimLeft(str, " \t")
+	if len(rest) == len(str) {
 		return Via{}, ErrParseError
 	}
 
-	return Via{
-		SIPVersion: strings.TrimSpace(result[1]),
-		Transport:  strings.TrimSpace(result[2]),
-		Client:     strings.TrimSpace(result[3]),
-		Arguments:  ParseHeaderArgs(strings.TrimSpace(result[4])),
-	}, nil
+	end := strings.IndexAny(rest, "; \t")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	v := Via{
+		SIPVersion: name + "/" + version,
+		Transport:  transport,
+		Client:     rest[:end],
+	}
+
+	if err := new(URI).parseHostport(v.Client); err != nil {
+		return Via{}, err
+	}
+
+	args, err := parseSemicolonArgs(rest[end:])
+	if err != nil {
+		return Via{}, err
+	}
+
+	v.Arguments = args
+	return v, nil
+}
+
+// ParseViaStack parses all of the Via hops of a header into a ViaStack.
+func ParseViaStack(h *Header) (ViaStack, error) {
+	var stack ViaStack
+	for _, value := range h.Values("Via") {
+		v, err := ParseVia(value)
+		if err != nil {
+			return nil, err
+		}
+
+		stack = append(stack, v)
+	}
+
+	return stack, nil
 }
 
 // String returns the string representation of the Via header line.
@@ -35,3 +89,99 @@ func (v Via) String() string {
 	return v.SIPVersion + "/" + v.Transport + " " + v.Client +
 		v.Arguments.SemicolonString()
 }
+
+// Host returns the host of the Via's sent-by, without the square brackets
+// of IPv6 references.
+func (v Via) Host() string {
+	u := new(URI)
+	u.parseHostport(v.Client)
+	return u.Host
+}
+
+// Port returns the port of the Via's sent-by, or 0 if it has no port.
+func (v Via) Port() int {
+	u := new(URI)
+	u.parseHostport(v.Client)
+	return u.Port
+}
+
+// Branch returns the branch parameter of the Via.
+func (v Via) Branch() string {
+	return v.Arguments.Get("branch")
+}
+
+// HasMagicCookie returns whether or not the branch parameter starts with
+// the RFC 3261 magic cookie, which means the branch can be used to
+// identify transactions.
+func (v Via) HasMagicCookie() bool {
+	return strings.HasPrefix(v.Branch(), MagicCookie)
+}
+
+// SetReceived adds the received and rport parameters to the Via according
+// to the address a request was received from, as described by RFC 3261
+// section 18.2.1 and RFC 3581. received is only added if the sent-by host
+// differs from the source address or the client requested rport, and rport
+// is only filled in if the client requested it.
+func (v *Via) SetReceived(addr net.Addr) {
+	ip, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+
+	rport, hasRport := v.Arguments.Lookup("rport")
+	if hasRport && rport == "" {
+		v.Arguments.Set("rport", port)
+	} else {
+		hasRport = false
+	}
+
+	if hasRport || !equalHost(v.Host(), ip) {
+		v.Arguments.Set("received", ip)
+	}
+}
+
+// Branch returns the branch parameter of the top Via.
+func (s ViaStack) Branch() string {
+	if len(s) == 0 {
+		return ""
+	}
+
+	return s[0].Branch()
+}
+
+// HasMagicCookie returns whether or not the branch of the top Via starts
+// with the RFC 3261 magic cookie.
+func (s ViaStack) HasMagicCookie() bool {
+	return len(s) > 0 && s[0].HasMagicCookie()
+}
+
+// SetHeader replaces the Via values of a header with the Via stack.
+func (s ViaStack) SetHeader(h *Header) {
+	h.Del("Via")
+	for _, v := range s {
+		h.Add("Via", v.String())
+	}
+}
+
+// readToken reads a token at the start of str, and returns the token and
+// the rest of the string.
+func readToken(str string) (string, string) {
+	end := 0
+	for end < len(str) && isTokenChar(str[end]) {
+		end++
+	}
+
+	return str[:end], str[end:]
+}
+
+// readSlashToken reads a slash followed by a token, with optional linear
+// white space around the slash.
+func readSlashToken(str string) (string, string, bool) {
+	str = strings.TrimLeft(str, " \t")
+	if !strings.HasPrefix(str, "/") {
+		return "", str, false
+	}
+
+	token, rest := readToken(strings.TrimLeft(str[1:], " \t"))
+	return token, rest, token != ""
+}